@@ -0,0 +1,107 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "time"
+)
+
+// -------------------- ACCESS LOG -------------------- //
+
+// Access log formats, from ACCESS_LOG
+const (
+    accessLogJSON = "json" // A slog record, like every other log line
+    accessLogText = "text" // An Apache-style line
+    accessLogOff  = "off"
+)
+
+// Format of the line logged per HTTP request, from ACCESS_LOG:
+var accessLogFormat = accessLogJSON
+
+// Routes not access-logged: the WebSocket upgrades hijack the connection,
+// so there is no status or size to record; connects are logged instead
+var accessLogSkipRoutes = map[string]bool{
+    "/ws":         true,
+    "/ws/control": true,
+}
+
+// accessLogMiddleware logs one line per request once it has been served,
+// with its status, size and duration
+func accessLogMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if accessLogFormat == accessLogOff || routeIn(r, accessLogSkipRoutes) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        start := time.Now()
+        rec := &responseRecorder{ResponseWriter: w}
+        next.ServeHTTP(rec, r)
+        logAccess(r, rec, time.Since(start))
+    })
+}
+
+// logAccess writes the access log line for r in accessLogFormat. Only the
+// path is logged: the query may carry the control token.
+func logAccess(r *http.Request, rec *responseRecorder, elapsed time.Duration) {
+    status := rec.status
+    if status == 0 {
+        // The handler wrote nothing, which net/http sends as a 200
+        status = http.StatusOK
+    }
+    if accessLogFormat == accessLogText {
+        requestID := requestIDFrom(r.Context())
+        if requestID == "" {
+            requestID = "-"
+        }
+        fmt.Fprintf(os.Stdout, "%s - - [%s] \"%s %s %s\" %d %d %.3fms %s\n",
+            remoteAddress(r), time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+            r.Method, r.URL.Path, r.Proto, status, rec.bytes,
+            float64(elapsed)/float64(time.Millisecond), requestID)
+        return
+    }
+    slog.InfoContext(r.Context(), "HTTP request",
+        "method", r.Method,
+        "path", r.URL.Path,
+        "status", status,
+        "bytes", rec.bytes,
+        "duration_ms", float64(elapsed)/float64(time.Millisecond),
+        "remote_addr", remoteAddress(r))
+}
+
+// responseRecorder passes a response through, noting its status code and
+// how many body bytes were written
+type responseRecorder struct {
+    http.ResponseWriter
+    status int   // 0 until the header is written
+    bytes  int64 // Body bytes sent, after any gzip
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+    if w.status == 0 {
+        w.status = status
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+    if w.status == 0 {
+        w.status = http.StatusOK
+    }
+    n, err := w.ResponseWriter.Write(p)
+    w.bytes += int64(n)
+    return n, err
+}
+
+// Flush lets event streams flush through the recorder
+func (w *responseRecorder) Flush() {
+    if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+        flusher.Flush()
+    }
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
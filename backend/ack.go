@@ -0,0 +1,95 @@
+package main
+
+import (
+    "log/slog"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// -------------------- ACKNOWLEDGEMENTS -------------------- //
+
+// How far an acking client's highest ack may trail the newest broadcast seq
+// before it is reported as behind, from ACK_LAG_THRESHOLD:
+var ackLagThreshold int64 = 50
+
+// How long an acking client may stay behind without acking anything newer
+// before it is disconnected, from ACK_TIMEOUT (unset, the default, never
+// disconnects):
+var ackTimeout time.Duration
+
+// Seq of the newest position this instance has broadcast
+var lastBroadcastSeq atomic.Int64
+
+// ackState tracks a client's {"type": "ack", "seq": n} replies. Clients
+// that never ack keep the zero value and are never checked.
+type ackState struct {
+    mu          sync.Mutex
+    seq         int64     // Highest seq acked
+    acking      bool      // Has acked at least once
+    behindSince time.Time // When a check first found seq behind since it last advanced
+    lagging     bool      // Already reported as more than ackLagThreshold behind
+}
+
+// noteBroadcastSeq raises lastBroadcastSeq to seq. Debounced and remote
+// broadcasts may arrive out of order, so it never goes down.
+func noteBroadcastSeq(seq int64) {
+    for {
+        cur := lastBroadcastSeq.Load()
+        if seq <= cur || lastBroadcastSeq.CompareAndSwap(cur, seq) {
+            return
+        }
+    }
+}
+
+// record notes an ack of seq
+func (a *ackState) record(seq int64) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.acking = true
+    if seq > a.seq {
+        // Progress restarts the timeout, even if newer positions are pending
+        a.seq = seq
+        a.behindSince = time.Time{}
+    }
+}
+
+// checkAcks compares the client's acks with the newest broadcast, logging
+// and counting clients that fall more than ackLagThreshold behind. It runs
+// on every ping and returns false once the client should be disconnected
+// for not acking within ackTimeout.
+func checkAcks(client *wsClient) bool {
+    a := &client.acks
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if !a.acking {
+        return true
+    }
+
+    lag := lastBroadcastSeq.Load() - a.seq
+    if lag <= 0 {
+        a.behindSince = time.Time{}
+        if a.lagging {
+            a.lagging = false
+            slog.Info("WebSocket client caught up on acks", "client_id", client.id, "acked_seq", a.seq)
+        }
+        return true
+    }
+
+    if a.behindSince.IsZero() {
+        a.behindSince = time.Now()
+    }
+    if lag > ackLagThreshold && !a.lagging {
+        a.lagging = true
+        ackLaggingTotal.Inc()
+        slog.Warn("WebSocket client is falling behind on acks",
+            "client_id", client.id, "acked_seq", a.seq, "lag", lag)
+    }
+    if ackTimeout > 0 && time.Since(a.behindSince) > ackTimeout {
+        ackTimeoutsTotal.Inc()
+        slog.Warn("WebSocket client stopped acking, disconnecting",
+            "client_id", client.id, "acked_seq", a.seq, "lag", lag)
+        return false
+    }
+    return true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "strconv"
+)
+
+// -------------------- AUDIT TRAIL -------------------- //
+
+// Redis stream every position change is recorded in, with who made it
+const auditKey = "carPosition:audit"
+
+// Number of audit entries kept, from AUDIT_MAX; 0 turns the trail off:
+var auditMax int64 = 10000
+
+// defaultAuditLimit is how many entries GET /audit returns without ?limit
+const defaultAuditLimit = 100
+
+// Where a change came from, recorded in the audit trail. Changes the server
+// makes itself, such as velocity ticks and replays, are auditSourceServer.
+const (
+    auditSourceHTTP   = "http"
+    auditSourceWS     = "ws"
+    auditSourceServer = "server"
+)
+
+// AuditEntry is one position change in the audit trail. Actor is the
+// writer recorded as lastWriter; DX and DY are as in position messages, so
+// 0 for absolute updates, where Old and New tell the change.
+type AuditEntry struct {
+    CarID  string  `json:"carId,omitempty"`
+    Actor  string  `json:"actor"`
+    Source string  `json:"source"`
+    DX     float64 `json:"dx"`
+    DY     float64 `json:"dy"`
+    OldX   float64 `json:"oldX"`
+    OldY   float64 `json:"oldY"`
+    NewX   float64 `json:"newX"`
+    NewY   float64 `json:"newY"`
+    Seq    int64   `json:"seq"`
+    TS     int64   `json:"ts"` // Unix milliseconds
+}
+
+// sourceKey is the context key holding the source of a change
+type sourceKey struct{}
+
+// withSource returns ctx tagged with where its changes come from
+func withSource(ctx context.Context, source string) context.Context {
+    return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// sourceFrom returns the source stored in ctx, or auditSourceServer
+func sourceFrom(ctx context.Context) string {
+    if source, ok := ctx.Value(sourceKey{}).(string); ok {
+        return source
+    }
+    return auditSourceServer
+}
+
+// queueAudit queues the audit entry for pos, made under ctx at ts, on pipe,
+// so it shares the round trip of the history and publish rather than adding
+// one. It returns nil if nothing was queued.
+func queueAudit(ctx context.Context, pipe Pipeline, pos PositionResponse, ts int64) func() error {
+    if auditMax == 0 {
+        return nil
+    }
+    entry, ok := marshalMessage(ctx, "audit", AuditEntry{
+        CarID:  pos.ID,
+        Actor:  writerFrom(ctx),
+        Source: sourceFrom(ctx),
+        DX:     pos.DX,
+        DY:     pos.DY,
+        OldX:   pos.oldX,
+        OldY:   pos.oldY,
+        NewX:   pos.X,
+        NewY:   pos.Y,
+        Seq:    pos.Seq,
+        TS:     ts,
+    })
+    if !ok {
+        return nil
+    }
+    return pipe.AppendStream(ctx, key(auditKey), string(entry), auditMax)
+}
+
+// getAudit returns the latest ?limit= audit entries, oldest first
+func getAudit(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    if auditMax == 0 {
+        writeJSONError(w, http.StatusNotFound, "the audit trail is off")
+        return
+    }
+    limit := int64(defaultAuditLimit)
+    if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+        n, err := strconv.ParseInt(limitStr, 10, 64)
+        if err != nil || n <= 0 {
+            writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+            return
+        }
+        limit = n
+    }
+    if limit > auditMax {
+        limit = auditMax
+    }
+
+    var raw []string
+    err := withReconnectRetry(ctx, func(ctx context.Context) (err error) {
+        raw, err = store.StreamTail(ctx, key(auditKey), limit)
+        return err
+    })
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    entries := make([]AuditEntry, 0, len(raw))
+    for _, item := range raw {
+        var entry AuditEntry
+        if err := json.Unmarshal([]byte(item), &entry); err != nil {
+            slog.WarnContext(ctx, "Skipping malformed audit entry", "error", err)
+            continue
+        }
+        entries = append(entries, entry)
+    }
+
+    _ = json.NewEncoder(w).Encode(entries)
+}
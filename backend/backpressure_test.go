@@ -0,0 +1,108 @@
+package main
+
+import (
+    "context"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+// registerTestClient registers a client with a send buffer of depth, as
+// serveWS would, and unregisters it when the test ends
+func registerTestClient(t testing.TB, id string, depth int) *wsClient {
+    t.Helper()
+    client := &wsClient{
+        id:    id,
+        ip:    "192.0.2.1",
+        shape: shapeStandard,
+        conn:  new(websocket.Conn),
+        send:  make(chan []byte, depth),
+    }
+    wsMutex.Lock()
+    wsClients[client.conn] = client
+    wsClientsByID[client.id] = client
+    wsPerIP[client.ip]++
+    wsMutex.Unlock()
+    t.Cleanup(func() {
+        wsMutex.Lock()
+        unregisterClientLocked(client)
+        wsMutex.Unlock()
+    })
+    return client
+}
+
+// setBackpressure sets wsBackpressure for the test
+func setBackpressure(t *testing.T, policy string) {
+    t.Helper()
+    prev := wsBackpressure
+    wsBackpressure = policy
+    t.Cleanup(func() { wsBackpressure = prev })
+}
+
+func TestDeliverDropOldestEvictsHead(t *testing.T) {
+    setBackpressure(t, "drop-oldest")
+    client := registerTestClient(t, "drop-oldest", 2)
+
+    for _, msg := range []string{"1", "2", "3"} {
+        if !client.deliver([]byte(msg)) {
+            t.Fatalf("deliver(%q) = false, want true under drop-oldest", msg)
+        }
+    }
+
+    if got := len(client.send); got != 2 {
+        t.Fatalf("queued %d messages, want 2", got)
+    }
+    for _, want := range []string{"2", "3"} {
+        if got := string(<-client.send); got != want {
+            t.Errorf("dequeued %q, want %q", got, want)
+        }
+    }
+    if client.overflows != 1 {
+        t.Errorf("overflows = %d, want 1", client.overflows)
+    }
+
+    wsMutex.Lock()
+    registered := wsClients[client.conn] == client
+    wsMutex.Unlock()
+    if !registered {
+        t.Error("client was unregistered under drop-oldest")
+    }
+}
+
+func TestDeliverDropClientUnregisters(t *testing.T) {
+    setBackpressure(t, "drop-client")
+    client := registerTestClient(t, "drop-client", 1)
+
+    if !client.deliver([]byte("1")) {
+        t.Fatal("deliver to a client with room = false, want true")
+    }
+    if client.deliver([]byte("2")) {
+        t.Fatal("deliver to a full client = true, want false under drop-client")
+    }
+
+    // The fan-out worker drops the client deliver refused
+    jobs := make(chan fanOutJob, 1)
+    jobs <- fanOutJob{ctx: context.Background(), clients: []*wsClient{client}, msg: wsMessage{v1: []byte("3")}}
+    close(jobs)
+    fanOutWorker(jobs)
+
+    wsMutex.Lock()
+    _, byConn := wsClients[client.conn]
+    _, byID := wsClientsByID[client.id]
+    wsMutex.Unlock()
+    if byConn || byID {
+        t.Error("full client is still registered under drop-client")
+    }
+    if client.closeCode != closeTooSlow {
+        t.Errorf("closeCode = %d, want closeTooSlow (%d)", client.closeCode, closeTooSlow)
+    }
+
+    // The queued message is still there for the writer to flush, then send
+    // reports it is closed
+    if got := string(<-client.send); got != "1" {
+        t.Errorf("dequeued %q, want %q", got, "1")
+    }
+    if _, ok := <-client.send; ok {
+        t.Error("send is still open after the client was dropped")
+    }
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+)
+
+// -------------------- BULK POSITIONS -------------------- //
+
+// Most car IDs accepted in one GET /cars, from CARS_MAX:
+var carsMax = 100
+
+// getCars returns the positions of every car in ?ids=a,b,c, keyed by ID,
+// e.g. for a dashboard. Cars never moved read as position 0, like GET
+// /cars/{id}/position.
+func getCars(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    ids := splitList(r.URL.Query().Get("ids"))
+    if len(ids) == 0 {
+        writeJSONError(w, http.StatusBadRequest, "ids is required")
+        return
+    }
+    if len(ids) > carsMax {
+        writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("at most %d ids are allowed", carsMax))
+        return
+    }
+    for _, id := range ids {
+        if !carIDPattern.MatchString(id) {
+            writeJSONError(w, http.StatusBadRequest, "invalid car id: "+id)
+            return
+        }
+    }
+
+    var positions map[string]PositionResponse
+    err := withReconnectRetry(ctx, func(ctx context.Context) (err error) {
+        positions, err = readPositions(ctx, ids)
+        return err
+    })
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    _ = json.NewEncoder(w).Encode(positions)
+}
+
+// readPositions is readPosition for many cars at once, in a single MGET
+func readPositions(ctx context.Context, ids []string) (map[string]PositionResponse, error) {
+    // seq first, then x, y, heading and laps of each car
+    const perCar = 4
+    keys := make([]string, 1, 1+perCar*len(ids))
+    keys[0] = key(seqKey)
+    for _, id := range ids {
+        xKey, yKey := positionKeys(id)
+        keys = append(keys, xKey, yKey, headingKey(id), lapsKey(id))
+    }
+    vals, err := store.GetFloat(ctx, keys...)
+    if err != nil {
+        return nil, err
+    }
+
+    positions := make(map[string]PositionResponse, len(ids))
+    for i, id := range ids {
+        v := vals[1+perCar*i:]
+        pos := newPositionResponse(id, v[0], v[1])
+        pos.Heading = normalizeHeading(int64(v[2]))
+        pos.Seq = int64(vals[0])
+        pos.placeOnTrack(v[3])
+        positions[id] = pos
+    }
+    return positions, nil
+}
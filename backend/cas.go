@@ -0,0 +1,72 @@
+package main
+
+import (
+    "encoding/json"
+    "log/slog"
+    "net/http"
+)
+
+// -------------------- COMPARE AND SET -------------------- //
+
+// CASRequest is the JSON body for POST /position/cas: set X to New, but only
+// if it is still Expected
+type CASRequest struct {
+    Expected *float64 `json:"expected" validate:"required"`
+    New      *float64 `json:"new" validate:"required"`
+}
+
+// casPosition sets the car's X exactly like PUT /position, but only if it
+// holds the expected value, so controllers acting on the same observed
+// position can't overwrite each other's moves. On a mismatch nothing is
+// written and the reply is 409 with the current X as its value.
+func casPosition(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+
+    var req CASRequest
+    if !decodeBody(w, r, &req) || !validateBody(w, &req) {
+        return
+    }
+    // Checked here rather than clamped afterwards, since a clamp would
+    // store something other than what the caller compared against
+    if errResp := absoluteError(*req.New); errResp != nil {
+        writeErrorResponse(w, *errResp)
+        return
+    }
+
+    // The swap bumps seq and records the writer in the same step, and
+    // reads back the state like storePosition
+    xKey, _ := positionKeys(id)
+    incr := stateIncrements(id, nil)
+    delete(incr, xKey)
+    current, vals, swapped, err := store.CompareAndSwap(ctx, xKey, *req.Expected, *req.New, incr, writeInfo(ctx, id))
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    if !swapped {
+        slog.InfoContext(ctx, "Compare-and-set mismatch",
+            "car_id", id, "expected", *req.Expected, "current", current)
+        writeErrorResponse(w, ErrorResponse{
+            Error:  "position is not the expected value",
+            Status: http.StatusConflict,
+            Value:  &current,
+        })
+        return
+    }
+    vals[xKey] = current
+    pos := stateFromIncrements(id, vals)
+    pos.oldX, pos.oldY = *req.Expected, pos.Y
+
+    publishPosition(ctx, pos)
+
+    _ = json.NewEncoder(w).Encode(pos)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "strconv"
+)
+
+// -------------------- CHANGES -------------------- //
+
+// Number of position changes kept per car for GET /position/changes, from
+// CHANGES_MAX:
+var changesMax int64 = 1000
+
+// ChangesResponse is returned by GET /position/changes. Truncated means
+// some changes after since have been dropped from the window, so Changes is
+// empty and Snapshot holds the current position to resync from.
+type ChangesResponse struct {
+    Changes   []PositionResponse `json:"changes"`
+    Truncated bool               `json:"truncated"`
+    Snapshot  *PositionResponse  `json:"snapshot,omitempty"`
+}
+
+// changesKey returns the Redis sorted set of the given car's recent
+// position messages, scored by seq
+func changesKey(id string) string {
+    if id == "" {
+        return key("carPosition:changes")
+    }
+    return key("carPosition:" + id + ":changes")
+}
+
+// getChanges returns the car's position changes with a seq above ?since=,
+// oldest first, for a client catching up on what it missed while
+// disconnected
+func getChanges(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+    var since int64
+    if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+        var err error
+        if since, err = strconv.ParseInt(sinceStr, 10, 64); err != nil {
+            writeJSONError(w, http.StatusBadRequest, "since must be a whole number")
+            return
+        }
+    }
+
+    var raw []string
+    var oldest float64
+    var size int64
+    err := withReconnectRetry(ctx, func(ctx context.Context) (err error) {
+        raw, oldest, size, err = store.ScoredAfter(ctx, changesKey(id), float64(since), changesMax)
+        return err
+    })
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    // The set keeps one change more than the window. Once it holds that
+    // many, the oldest is the newest change outside the window, so changes
+    // after since are missing exactly if it is one of them. Seqs are
+    // shared by every car, so a gap alone wouldn't tell.
+    resp := ChangesResponse{Changes: []PositionResponse{}}
+    resp.Truncated = size > changesMax && oldest > float64(since)
+    if resp.Truncated {
+        pos, err := readPosition(ctx, id)
+        if err != nil {
+            writeJSONError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        resp.Snapshot = &pos
+        _ = json.NewEncoder(w).Encode(resp)
+        return
+    }
+
+    for _, item := range raw {
+        var pos PositionResponse
+        if err := json.Unmarshal([]byte(item), &pos); err != nil {
+            slog.WarnContext(ctx, "Skipping malformed position change", "car_id", id, "error", err)
+            continue
+        }
+        resp.Changes = append(resp.Changes, pos)
+    }
+
+    _ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+    "encoding/json"
+    "math/rand"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// -------------------- CLOSE FRAMES -------------------- //
+
+// Close codes the server sends when it sheds a client:
+//
+//     1001 going away       the server is shutting down
+//     1008 policy violation an operator disconnected the client
+//     1013 try again later  MAX_WS_CLIENTS is reached
+//     4000 too slow         the client's send buffer filled up, or it stopped
+//                           acking within ACK_TIMEOUT
+//
+// A client whose connection just breaks sees no close frame at all.
+const (
+    closeGoingAway       = websocket.CloseGoingAway
+    closePolicyViolation = websocket.ClosePolicyViolation
+    closeTryAgainLater   = websocket.CloseTryAgainLater
+    closeTooSlow         = 4000
+)
+
+// Suggested waits before reconnecting, before jitter. Operator disconnects
+// suggest none.
+const (
+    shutdownReconnectAfter = 2 * time.Second
+    fullReconnectAfter     = 10 * time.Second
+    slowReconnectAfter     = time.Second
+)
+
+// Reasons sent with each close code
+var closeReasons = map[int]string{
+    closeGoingAway:       "server shutting down",
+    closePolicyViolation: "disconnected by operator",
+    closeTryAgainLater:   "too many WebSocket clients",
+    closeTooSlow:         "client too slow",
+}
+
+// Longest reason a close frame can carry, per RFC 6455
+const maxCloseReasonLen = 123
+
+// CloseReason is the JSON reason of every close frame the server sends.
+// ReconnectAfterMs is randomized so shed clients don't all come back at
+// once, and omitted when the client shouldn't reconnect on its own.
+type CloseReason struct {
+    Reason           string `json:"reason"`
+    ReconnectAfterMs int64  `json:"reconnectAfterMs,omitempty"`
+}
+
+// closeClient sends conn a close frame with code, its usual reason and a
+// jittered reconnectAfter (0 for none). It doesn't unregister the client;
+// callers still do.
+func closeClient(conn *websocket.Conn, code int, reconnectAfter time.Duration) {
+    frame, _ := closeFrame(code, closeReasons[code], reconnectAfter)
+    writeCloseFrame(conn, frame)
+}
+
+// writeCloseFrame sends a frame built by closeFrame
+func writeCloseFrame(conn *websocket.Conn, frame []byte) {
+    // WriteControl is safe to call concurrently with the writer goroutine
+    _ = conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(time.Second))
+}
+
+// closeFrame builds a close frame with code and reason, suggesting a wait
+// of between half and all of reconnectAfter. ok is false, and the frame
+// has no reason, if the encoded reason doesn't fit.
+func closeFrame(code int, reason string, reconnectAfter time.Duration) (frame []byte, ok bool) {
+    msg := CloseReason{Reason: reason}
+    if d := reconnectAfter; d > 0 {
+        d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+        msg.ReconnectAfterMs = d.Milliseconds()
+    }
+    data, err := json.Marshal(msg)
+    if err != nil || len(data) > maxCloseReasonLen {
+        return websocket.FormatCloseMessage(code, ""), false
+    }
+    return websocket.FormatCloseMessage(code, string(data)), true
+}
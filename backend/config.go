@@ -0,0 +1,298 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "math"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+
+    "github.com/joho/godotenv"
+    "golang.org/x/time/rate"
+)
+
+// -------------------- CONFIG -------------------- //
+
+// Config holds the settings a running server picks up again on SIGHUP.
+// Everything else is read once in main; see restartOnlyEnv.
+type Config struct {
+    // Origins allowed for both CORS and WebSocket upgrades, from the
+    // comma-separated ALLOWED_ORIGINS. "*" allows any origin.
+    AllowedOrigins []string
+
+    // Methods and request headers advertised to CORS preflights, from the
+    // comma-separated CORS_METHODS and CORS_HEADERS
+    CORSMethods []string
+    CORSHeaders []string
+
+    // Whether browsers may send cookies and auth headers cross-origin, from
+    // CORS_ALLOW_CREDENTIALS. Since "*" is invalid with credentials, the
+    // request's origin is echoed instead.
+    CORSAllowCredentials bool
+
+    // Per-IP token bucket for write routes, from RATE_LIMIT_RPS and RATE_LIMIT_BURST
+    RateLimitRPS   rate.Limit
+    RateLimitBurst int
+
+    // Bounds for each axis, from MIN_POSITION and MAX_POSITION
+    MinPosition float64
+    MaxPosition float64
+
+    // Largest delta a single update may apply, from MAX_DELTA
+    MaxDelta int
+}
+
+// defaultConfig returns the settings used when no env var overrides them
+func defaultConfig() Config {
+    return Config{
+        AllowedOrigins: []string{"*"},
+        CORSMethods:    []string{"GET", "POST", "PUT", "OPTIONS"},
+        CORSHeaders:    []string{"Content-Type", "Authorization", "X-Request-ID", "Idempotency-Key", "X-Controller-ID"},
+        RateLimitRPS:   10,
+        RateLimitBurst: 20,
+        MinPosition:    0,
+        MaxPosition:    math.Inf(1),
+        MaxDelta:       1000,
+    }
+}
+
+var config = defaultConfig()
+var configMutex sync.RWMutex // Protects config
+
+// currentConfig returns the live config. Callers should take it once per
+// request so a reload can't change settings halfway through.
+func currentConfig() Config {
+    configMutex.RLock()
+    defer configMutex.RUnlock()
+    return config
+}
+
+// loadConfig reads Config from the environment on top of the defaults. The
+// bounds are checked against POSITION_MODE, so that must be parsed first.
+func loadConfig() (Config, error) {
+    cfg := defaultConfig()
+    var err error
+
+    if minStr := os.Getenv("MIN_POSITION"); minStr != "" {
+        cfg.MinPosition, err = strconv.ParseFloat(minStr, 64)
+        if err != nil || !representable(cfg.MinPosition) {
+            return cfg, fmt.Errorf("invalid MIN_POSITION value %q", minStr)
+        }
+    }
+    if maxStr := os.Getenv("MAX_POSITION"); maxStr != "" {
+        cfg.MaxPosition, err = strconv.ParseFloat(maxStr, 64)
+        if err != nil || !representable(cfg.MaxPosition) {
+            return cfg, fmt.Errorf("invalid MAX_POSITION value %q", maxStr)
+        }
+    }
+    if cfg.MinPosition > cfg.MaxPosition {
+        return cfg, fmt.Errorf("MIN_POSITION (%v) must not be greater than MAX_POSITION (%v)",
+            cfg.MinPosition, cfg.MaxPosition)
+    }
+
+    if deltaStr := os.Getenv("MAX_DELTA"); deltaStr != "" {
+        cfg.MaxDelta, err = strconv.Atoi(deltaStr)
+        if err != nil || cfg.MaxDelta <= 0 {
+            return cfg, fmt.Errorf("invalid MAX_DELTA value %q", deltaStr)
+        }
+    }
+
+    if originsStr := os.Getenv("ALLOWED_ORIGINS"); originsStr != "" {
+        cfg.AllowedOrigins = splitList(originsStr)
+    }
+    if methodsStr := os.Getenv("CORS_METHODS"); methodsStr != "" {
+        cfg.CORSMethods = splitList(methodsStr)
+    }
+    if headersStr := os.Getenv("CORS_HEADERS"); headersStr != "" {
+        cfg.CORSHeaders = splitList(headersStr)
+    }
+    if credStr := os.Getenv("CORS_ALLOW_CREDENTIALS"); credStr != "" {
+        cfg.CORSAllowCredentials, err = strconv.ParseBool(credStr)
+        if err != nil {
+            return cfg, fmt.Errorf("invalid CORS_ALLOW_CREDENTIALS value %q", credStr)
+        }
+    }
+
+    if rpsStr := os.Getenv("RATE_LIMIT_RPS"); rpsStr != "" {
+        rps, err := strconv.ParseFloat(rpsStr, 64)
+        if err != nil || rps <= 0 {
+            return cfg, fmt.Errorf("invalid RATE_LIMIT_RPS value %q", rpsStr)
+        }
+        cfg.RateLimitRPS = rate.Limit(rps)
+    }
+    if burstStr := os.Getenv("RATE_LIMIT_BURST"); burstStr != "" {
+        cfg.RateLimitBurst, err = strconv.Atoi(burstStr)
+        if err != nil || cfg.RateLimitBurst <= 0 {
+            return cfg, fmt.Errorf("invalid RATE_LIMIT_BURST value %q", burstStr)
+        }
+    }
+    return cfg, nil
+}
+
+// LogValue lists every setting, so logs show exactly what took effect
+func (c Config) LogValue() slog.Value {
+    return slog.GroupValue(
+        slog.Any("allowed_origins", c.AllowedOrigins),
+        slog.Any("cors_methods", c.CORSMethods),
+        slog.Any("cors_headers", c.CORSHeaders),
+        slog.Bool("cors_allow_credentials", c.CORSAllowCredentials),
+        slog.Float64("rate_limit_rps", float64(c.RateLimitRPS)),
+        slog.Int("rate_limit_burst", c.RateLimitBurst),
+        // JSON has no infinity, so the bounds are logged as strings
+        slog.String("min_position", formatFloat(c.MinPosition)),
+        slog.String("max_position", formatFloat(c.MaxPosition)),
+        slog.Int("max_delta", c.MaxDelta),
+    )
+}
+
+// originAllowed reports whether origin is in AllowedOrigins, or any origin
+// is allowed via "*"
+func (c Config) originAllowed(origin string) bool {
+    for _, allowed := range c.AllowedOrigins {
+        if allowed == "*" || allowed == origin {
+            return true
+        }
+    }
+    return false
+}
+
+// -------------------- RELOAD -------------------- //
+
+// envFile is the optional dotenv file read at startup and again on SIGHUP
+const envFile = ".env"
+
+// Env vars set by the process environment, which envFile never overrides
+var inheritedEnv = make(map[string]bool)
+
+// Keys last applied from envFile, so ones removed from it can be unset
+var fileEnv = make(map[string]bool)
+
+// Env vars only read at startup. A reload that changes one logs it as ignored.
+var restartOnlyEnv = []string{
+    "PORT", "LISTEN_ADDR", "TLS_CERT_FILE", "TLS_KEY_FILE",
+    "STORE_BACKEND", "REDIS_ADDR", "REDIS_PASS", "REDIS_DB", "REDIS_PREFIX",
+    "LOG_LEVEL", "ACCESS_LOG", "POSITION_MODE", "MOVEMENT_MODE", "INITIAL_POSITION", "TRACK_LENGTH", "CONTROL_TOKEN", "TRUST_PROXY", "MAINTENANCE_MODE", "AUTO_REPAIR", "TEST_MODE",
+    "REPLAY_FILE", "REPLAY_LOOP", "SNAPSHOT_FILE", "SNAPSHOT_INTERVAL",
+    "GZIP_MIN_BYTES", "MAX_BODY_BYTES", "BATCH_MAX", "CARS_MAX", "HISTORY_MAX", "CHANGES_MAX", "AUDIT_MAX",
+    "WS_PROTOCOL", "BROADCAST_FORMAT", "MAX_WS_CLIENTS", "MAX_WS_PER_IP", "BROADCAST_WORKERS", "WS_BACKPRESSURE", "BROADCAST_QUEUE_DEPTH",
+    "ACK_LAG_THRESHOLD", "ACK_TIMEOUT",
+    "WS_PONG_WAIT", "WS_PING_INTERVAL", "WS_WRITE_TIMEOUT", "WS_MAX_MESSAGE_BYTES",
+    "WS_READ_BUFFER", "WS_WRITE_BUFFER", "WS_COMPRESSION",
+    "BROADCAST_DEBOUNCE_MS", "SIMULATE_LATENCY_MS", "SIMULATE_JITTER_MS",
+    "TICK_MS", "STORE_HEALTH_INTERVAL", "REQUEST_TIMEOUT", "HANDLER_TIMEOUT", "POLL_TIMEOUT", "IDEMPOTENCY_TTL",
+    "STORE_RETRY_ATTEMPTS", "STORE_RETRY_DELAY",
+}
+
+// Values of restartOnlyEnv when the server started
+var startupEnv = make(map[string]string)
+
+// loadEnv applies envFile on top of the process environment, like
+// godotenv.Load. It must run before anything reads the environment.
+func loadEnv() error {
+    for _, kv := range os.Environ() {
+        key, _, _ := strings.Cut(kv, "=")
+        inheritedEnv[key] = true
+    }
+    err := loadEnvFile()
+    for _, name := range restartOnlyEnv {
+        startupEnv[name] = os.Getenv(name)
+    }
+    return err
+}
+
+// loadEnvFile sets every variable in envFile that the process environment
+// doesn't, and unsets ones an earlier read set but the file no longer has.
+func loadEnvFile() error {
+    values, err := godotenv.Read(envFile)
+    if err != nil {
+        return err
+    }
+    for key := range fileEnv {
+        if _, ok := values[key]; !ok {
+            _ = os.Unsetenv(key)
+            delete(fileEnv, key)
+        }
+    }
+    for key, value := range values {
+        if inheritedEnv[key] {
+            continue
+        }
+        _ = os.Setenv(key, value)
+        fileEnv[key] = true
+    }
+    return nil
+}
+
+// reloadConfig re-reads envFile and swaps in the new Config. An invalid
+// setting leaves the running config untouched. WebSocket clients stay
+// connected, even if their origin is no longer allowed.
+func reloadConfig() {
+    if err := loadEnvFile(); err != nil {
+        slog.Warn("Could not read env file; reloading from the environment only", "file", envFile, "error", err)
+    }
+    for _, name := range restartOnlyEnv {
+        if os.Getenv(name) != startupEnv[name] {
+            slog.Warn("Ignoring change to a setting that needs a restart", "var", name)
+        }
+    }
+
+    cfg, err := loadConfig()
+    if err != nil {
+        slog.Error("Config reload failed; keeping the current config", "error", err)
+        return
+    }
+    configMutex.Lock()
+    config = cfg
+    configMutex.Unlock()
+    applyRateLimit(cfg.RateLimitRPS, cfg.RateLimitBurst)
+
+    slog.Info("Config reloaded", "config", cfg)
+}
+
+// -------------------- STARTUP SUMMARY -------------------- //
+
+// startupConfig is the effective configuration main logs once at boot.
+// RedisPass and ControlToken are only ever shown redacted.
+type startupConfig struct {
+    Addr         string
+    TLS          bool
+    StoreBackend string
+    RedisAddr    string
+    RedisDB      int
+    RedisPrefix  string
+    RedisPass    string
+    ControlToken string
+    PositionMode string
+    Config       Config
+}
+
+// LogValue is the redacted form of s for slog
+func (s startupConfig) LogValue() slog.Value {
+    return slog.GroupValue(
+        slog.String("addr", s.Addr),
+        slog.Bool("tls", s.TLS),
+        slog.String("store_backend", s.StoreBackend),
+        slog.String("redis_addr", s.RedisAddr),
+        slog.Int("redis_db", s.RedisDB),
+        slog.String("redis_prefix", s.RedisPrefix),
+        slog.String("redis_pass", redact(s.RedisPass)),
+        slog.String("control_token", redact(s.ControlToken)),
+        slog.String("position_mode", s.PositionMode),
+        slog.Any("config", s.Config),
+    )
+}
+
+// String keeps secrets out of fmt output too
+func (s startupConfig) String() string {
+    return s.LogValue().Resolve().String()
+}
+
+// redact hides a secret, leaving only whether it is set
+func redact(secret string) string {
+    if secret == "" {
+        return ""
+    }
+    return "***"
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+)
+
+// -------------------- CORRUPTED VALUES -------------------- //
+
+// Whether a key found holding something other than a number is reset to 0
+// and the read retried, from AUTO_REPAIR. Off by default, since the reset
+// loses whatever was there; reads then fail with a 500 naming the keys.
+var autoRepair bool
+
+// repairCorruption logs err if it is a CorruptValueError and, with
+// AUTO_REPAIR, resets the keys it names to 0. It reports whether they were
+// reset, so the caller can retry.
+func repairCorruption(ctx context.Context, err error) bool {
+    var corrupt *CorruptValueError
+    if !errors.As(err, &corrupt) {
+        return false
+    }
+    for key, value := range corrupt.Values {
+        corruptValuesTotal.Inc()
+        slog.ErrorContext(ctx, "Corrupted value in store",
+            "key", key, "value", value, "auto_repair", autoRepair)
+    }
+    if !autoRepair {
+        return false
+    }
+
+    repaired := make(map[string]int64, len(corrupt.Values))
+    for key := range corrupt.Values {
+        repaired[key] = 0
+    }
+    if err := store.Set(ctx, repaired); err != nil {
+        slog.ErrorContext(ctx, "Error repairing corrupted value", "error", err)
+        return false
+    }
+    for key := range corrupt.Values {
+        slog.WarnContext(ctx, "Repaired corrupted value by resetting it to 0", "key", key)
+    }
+    return true
+}
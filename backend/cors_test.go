@@ -0,0 +1,74 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// setTestConfig makes cfg the current Config for the test
+func setTestConfig(t testing.TB, cfg Config) {
+    t.Helper()
+    configMutex.Lock()
+    prev := config
+    config = cfg
+    configMutex.Unlock()
+    t.Cleanup(func() {
+        configMutex.Lock()
+        config = prev
+        configMutex.Unlock()
+    })
+}
+
+func TestPreflight(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.AllowedOrigins = []string{"https://viewer.example"}
+    setTestConfig(t, cfg)
+    r := newRouter()
+
+    // A GET-only route and a write route, which has no OPTIONS of its own
+    for _, path := range []string{"/healthz", "/position", "/cars/a1/position/cas"} {
+        t.Run(path, func(t *testing.T) {
+            req := httptest.NewRequest(http.MethodOptions, path, nil)
+            req.Header.Set("Origin", "https://viewer.example")
+            req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+            rec := httptest.NewRecorder()
+            r.ServeHTTP(rec, req)
+
+            if rec.Code != http.StatusNoContent {
+                t.Errorf("status = %d, want %d", rec.Code, http.StatusNoContent)
+            }
+            for header, want := range map[string]string{
+                "Access-Control-Allow-Origin":  "https://viewer.example",
+                "Access-Control-Allow-Methods": strings.Join(cfg.CORSMethods, ", "),
+                "Access-Control-Allow-Headers": strings.Join(cfg.CORSHeaders, ", "),
+                "Access-Control-Max-Age":       "3600",
+                "Vary":                         "Origin",
+            } {
+                if got := rec.Header().Get(header); got != want {
+                    t.Errorf("%s = %q, want %q", header, got, want)
+                }
+            }
+            if rec.Body.Len() != 0 {
+                t.Errorf("body = %q, want none", rec.Body.String())
+            }
+        })
+    }
+}
+
+func TestPreflightOtherOrigin(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.AllowedOrigins = []string{"https://viewer.example"}
+    setTestConfig(t, cfg)
+
+    req := httptest.NewRequest(http.MethodOptions, "/position", nil)
+    req.Header.Set("Origin", "https://elsewhere.example")
+    req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+    rec := httptest.NewRecorder()
+    newRouter().ServeHTTP(rec, req)
+
+    if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+        t.Errorf("Access-Control-Allow-Origin = %q for a disallowed origin, want none", got)
+    }
+}
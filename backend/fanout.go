@@ -0,0 +1,130 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "runtime"
+    "sync"
+    "sync/atomic"
+)
+
+// -------------------- FAN-OUT WORKERS -------------------- //
+
+// Goroutines delivering broadcasts to WebSocket clients, from
+// BROADCAST_WORKERS (defaults to the number of CPUs). Each owns a fixed
+// shard of the clients, so a client's messages always arrive in order.
+var broadcastWorkers = runtime.NumCPU()
+
+// How many broadcasts may wait for a busy worker before fanOutPosition blocks
+const fanOutQueueSize = 256
+
+// fanOutJob is one broadcast for one shard
+type fanOutJob struct {
+    ctx     context.Context // Delivery stops once it is cancelled
+    clients []*wsClient
+    msg     wsMessage
+}
+
+// One queue per worker; index with wsClient.shard
+var fanOutQueues []chan fanOutJob
+
+// Round-robin counter assigning new clients to shards
+var nextShard atomic.Uint64
+
+// Context of broadcasts not tied to anything shorter, cancelled on shutdown
+// so the workers stop instead of finishing every client. A request's
+// context would do for none of them: it ends when the handler returns,
+// usually before the workers get to the job.
+var broadcastCtx, stopBroadcasts = context.WithCancel(context.Background())
+
+// Serializes dispatching, so every shard sees broadcasts in the same order
+var fanOutMutex sync.Mutex
+
+// startFanOutWorkers starts broadcastWorkers workers. It must run before
+// any client connects.
+func startFanOutWorkers() {
+    fanOutQueues = make([]chan fanOutJob, broadcastWorkers)
+    for i := range fanOutQueues {
+        fanOutQueues[i] = make(chan fanOutJob, fanOutQueueSize)
+        go fanOutWorker(fanOutQueues[i])
+    }
+}
+
+// queuedBroadcasts is how many broadcasts wait for a worker
+func queuedBroadcasts() int {
+    n := 0
+    for _, queue := range fanOutQueues {
+        n += len(queue)
+    }
+    return n
+}
+
+// assignShard picks the worker that will deliver broadcasts to a new client
+func assignShard() int {
+    return int(nextShard.Add(1) % uint64(len(fanOutQueues)))
+}
+
+// dispatchFanOut hands msg to every client; see dispatchFanOutTo
+func dispatchFanOut(ctx context.Context, msg wsMessage) {
+    dispatchFanOutTo(ctx, msg, nil)
+}
+
+// dispatchCarFanOut hands msg, an update of car id, to the clients watching
+// that car
+func dispatchCarFanOut(ctx context.Context, id string, msg wsMessage) {
+    dispatchFanOutTo(ctx, msg, func(client *wsClient) bool {
+        return client.watchesLocked(id)
+    })
+}
+
+// dispatchFanOutTo splits the current clients for which want returns true
+// (all of them if want is nil) into shards and hands msg to each shard's
+// worker. Only the client list is copied under wsMutex, where want is
+// called; the sends happen on the workers, which give up on the rest of the
+// clients once ctx is cancelled.
+func dispatchFanOutTo(ctx context.Context, msg wsMessage, want func(*wsClient) bool) {
+    fanOutMutex.Lock()
+    defer fanOutMutex.Unlock()
+
+    shards := make([][]*wsClient, len(fanOutQueues))
+    wsMutex.Lock()
+    for _, client := range wsClients {
+        if want != nil && !want(client) {
+            continue
+        }
+        shards[client.shard] = append(shards[client.shard], client)
+    }
+    wsMutex.Unlock()
+
+    // Outside wsMutex: a full queue blocks here until its worker catches
+    // up, and the worker may need wsMutex to drop a slow client
+    for i, clients := range shards {
+        if len(clients) == 0 {
+            continue
+        }
+        select {
+        case fanOutQueues[i] <- fanOutJob{ctx: ctx, clients: clients, msg: msg}:
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+// fanOutWorker delivers each job to its clients, dropping the rest of a job
+// whose context is cancelled. A client that disconnected after the job was
+// dispatched is skipped by deliver.
+func fanOutWorker(jobs <-chan fanOutJob) {
+    for job := range jobs {
+        for _, client := range job.clients {
+            if job.ctx.Err() != nil {
+                break
+            }
+            if client.deliver(job.msg.forClient(client)) {
+                continue
+            }
+            slog.Warn("WebSocket client send buffer full, dropping connection", "client_id", client.id)
+            broadcastErrorsTotal.Inc()
+            shedClient(client, closeTooSlow, slowReconnectAfter)
+        }
+    }
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "runtime"
+    "sync"
+    "sync/atomic"
+    "testing"
+)
+
+// fanOutClients is how many clients BenchmarkFanout broadcasts to
+const fanOutClients = 5000
+
+// startWorkersOnce keeps benchmarks run with several -cpu values from
+// starting more workers each time
+var startWorkersOnce sync.Once
+
+// BenchmarkFanout measures how long a broadcast to 5000 clients holds up the
+// broadcasting goroutine, and with it wsMutex: "locked" delivers to every
+// client under the lock, as broadcasts did before the fan-out workers, and
+// "sharded" is dispatchFanOut, which only copies the client list under it.
+// Delivery itself is waited for outside the timer. Run it with -cpu 1 to
+// compare both on a single CPU.
+func BenchmarkFanout(b *testing.B) {
+    startWorkersOnce.Do(func() {
+        broadcastWorkers = runtime.GOMAXPROCS(0)
+        startFanOutWorkers()
+    })
+
+    var delivered atomic.Int64
+    for i := 0; i < fanOutClients; i++ {
+        client := registerTestClient(b, fmt.Sprintf("bench-%d", i), sendBufferSize)
+        client.shard = assignShard()
+        go func() {
+            for range client.send {
+                delivered.Add(1)
+            }
+        }()
+    }
+    msg, ok := encodeMessage("position", newPositionResponse("", 1, 2))
+    if !ok {
+        b.Fatal("encoding the position failed")
+    }
+
+    // waitDelivered blocks until every client has taken n broadcasts
+    waitDelivered := func(n int64) {
+        for delivered.Load() < n*fanOutClients {
+            runtime.Gosched()
+        }
+    }
+
+    b.Run("locked", func(b *testing.B) {
+        delivered.Store(0)
+        for i := 0; i < b.N; i++ {
+            wsMutex.Lock()
+            for _, client := range wsClients {
+                client.deliver(msg.forClient(client))
+            }
+            wsMutex.Unlock()
+
+            b.StopTimer()
+            waitDelivered(int64(i + 1))
+            b.StartTimer()
+        }
+    })
+
+    b.Run("sharded", func(b *testing.B) {
+        delivered.Store(0)
+        for i := 0; i < b.N; i++ {
+            dispatchFanOut(context.Background(), msg)
+
+            b.StopTimer()
+            waitDelivered(int64(i + 1))
+            b.StartTimer()
+        }
+    })
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "compress/gzip"
+    "net/http"
+    "strings"
+)
+
+// -------------------- GZIP -------------------- //
+
+// Smallest response body that gets gzipped, from GZIP_MIN_BYTES (0 turns
+// compression off):
+var gzipMinBytes = 1024
+
+// Routes never compressed: the WebSocket upgrade, streams that must flush
+// each event, small position replies, and /metrics, which compresses itself
+var gzipSkipRoutes = map[string]bool{
+    "/ws":                        true,
+    "/ws/control":                true,
+    "/position":                  true,
+    "/cars/{id}/position":        true,
+    "/position/stream":           true,
+    "/cars/{id}/position/stream": true,
+    "/position/poll":             true,
+    "/cars/{id}/position/poll":   true,
+    "/metrics":                   true,
+}
+
+// gzipMiddleware compresses responses of at least gzipMinBytes for clients
+// that send "Accept-Encoding: gzip"
+func gzipMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if gzipMinBytes == 0 || routeIn(r, gzipSkipRoutes) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        w.Header().Add("Vary", "Accept-Encoding")
+        if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+        defer gw.finish()
+        next.ServeHTTP(gw, r)
+    })
+}
+
+// gzipResponseWriter buffers the start of a response until it knows whether
+// the body reaches gzipMinBytes, then either compresses or passes it through
+type gzipResponseWriter struct {
+    http.ResponseWriter
+    status  int
+    buf     []byte
+    gz      *gzip.Writer // Set once compressing
+    started bool         // Header sent, uncompressed
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+    w.status = status
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+    switch {
+    case w.gz != nil:
+        return w.gz.Write(p)
+    case w.started:
+        return w.ResponseWriter.Write(p)
+    }
+
+    w.buf = append(w.buf, p...)
+    if len(w.buf) < gzipMinBytes {
+        return len(p), nil
+    }
+
+    // Big enough; compress unless the handler already encoded the body
+    if w.Header().Get("Content-Encoding") != "" {
+        w.start()
+        return len(p), nil
+    }
+    w.Header().Set("Content-Encoding", "gzip")
+    w.Header().Del("Content-Length")
+    w.ResponseWriter.WriteHeader(w.status)
+    w.gz = gzip.NewWriter(w.ResponseWriter)
+    if _, err := w.gz.Write(w.buf); err != nil {
+        return 0, err
+    }
+    w.buf = nil
+    return len(p), nil
+}
+
+// start sends the header and anything buffered without compression
+func (w *gzipResponseWriter) start() {
+    w.started = true
+    w.ResponseWriter.WriteHeader(w.status)
+    if len(w.buf) > 0 {
+        _, _ = w.ResponseWriter.Write(w.buf)
+    }
+    w.buf = nil
+}
+
+// finish flushes whatever the handler left: the gzip trailer, or a body too
+// small to compress
+func (w *gzipResponseWriter) finish() {
+    if w.gz != nil {
+        _ = w.gz.Close()
+        return
+    }
+    if !w.started {
+        w.start()
+    }
+}
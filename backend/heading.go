@@ -0,0 +1,82 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+)
+
+// -------------------- HEADING -------------------- //
+
+// HeadingRequest is the JSON body for POST /heading: either an absolute
+// Heading in degrees (0-359) or a relative Turn, positive clockwise.
+type HeadingRequest struct {
+    Heading *int `json:"heading"`
+    Turn    int  `json:"turn"`
+}
+
+// headingKey returns the Redis key holding the given car's heading. Turns
+// are applied with INCRBY so concurrent ones never get lost, which means the
+// stored value is the cumulative angle; readers reduce it with normalizeHeading.
+func headingKey(id string) string {
+    if id == "" {
+        return key("carPosition:heading")
+    }
+    return key("carPosition:" + id + ":heading")
+}
+
+// normalizeHeading reduces an angle in degrees to [0, 360), so that e.g.
+// turning -10 from 5 gives 355
+func normalizeHeading(deg int64) int {
+    return int((deg%360 + 360) % 360)
+}
+
+// setHeading sets or rotates the car's heading, then broadcasts
+func setHeading(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+
+    var req HeadingRequest
+    if !decodeBody(w, r, &req) {
+        return
+    }
+
+    var pos PositionResponse
+    var err error
+    switch {
+    case req.Heading != nil && req.Turn != 0:
+        writeJSONError(w, http.StatusBadRequest, "use either heading or turn, not both")
+        return
+    case req.Heading != nil:
+        if *req.Heading < 0 || *req.Heading > 359 {
+            value := float64(*req.Heading)
+            writeErrorResponse(w, ErrorResponse{
+                Error:  "heading must be between 0 and 359",
+                Status: http.StatusBadRequest,
+                Value:  &value,
+            })
+            return
+        }
+        pos, err = storePosition(ctx, id, map[string]float64{headingKey(id): float64(*req.Heading)})
+    case req.Turn != 0:
+        pos, err = incrementState(ctx, id, map[string]float64{headingKey(id): float64(req.Turn)})
+    default:
+        writeJSONError(w, http.StatusBadRequest, "heading or turn is required")
+        return
+    }
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    publishPosition(ctx, pos)
+
+    _ = json.NewEncoder(w).Encode(pos)
+}
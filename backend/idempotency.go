@@ -0,0 +1,128 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+// -------------------- IDEMPOTENCY -------------------- //
+
+// idempotencyHeader lets clients retry POST /position without double-moving
+const idempotencyHeader = "Idempotency-Key"
+
+// Longest accepted Idempotency-Key
+const maxIdempotencyKeyLen = 255
+
+// How long a processed Idempotency-Key is remembered, from IDEMPOTENCY_TTL:
+var idempotencyTTL = 60 * time.Second
+
+// idempotencyRecord is what we keep per key. Response is nil while the first
+// request is still being applied, and if it failed in a way that may have
+// applied it anyway, which Unknown records.
+type idempotencyRecord struct {
+    DX       float64         `json:"dx"`
+    DY       float64         `json:"dy"`
+    Response *UpdateResponse `json:"response,omitempty"`
+    Unknown  bool            `json:"unknown,omitempty"`
+}
+
+// idempotencyKey returns the Redis key remembering idemKey for car id
+func idempotencyKey(id, idemKey string) string {
+    if id == "" {
+        return key("carPosition:idempotency:" + idemKey)
+    }
+    return key("carPosition:" + id + ":idempotency:" + idemKey)
+}
+
+// moveOnce applies a validated move at most once per Idempotency-Key and
+// writes the reply. A repeat gets the first request's response; a repeat
+// while the first is still running, or after it failed with an unknown
+// outcome, gets 409, and reusing a key for a different delta gets 422.
+func moveOnce(ctx context.Context, w http.ResponseWriter, id, key string, dx, dy float64) {
+    redisKey := idempotencyKey(id, key)
+    pending, _ := json.Marshal(idempotencyRecord{DX: dx, DY: dy})
+
+    claimed, err := store.SetNX(ctx, redisKey, string(pending), idempotencyTTL)
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    if !claimed {
+        replayMove(ctx, w, redisKey, dx, dy)
+        return
+    }
+
+    res, err := moveCar(ctx, id, dx, dy)
+    if err != nil {
+        releaseOrMarkUnknown(ctx, id, redisKey, dx, dy, err)
+        writeMoveError(ctx, w, err)
+        return
+    }
+
+    resp := UpdateResponse{PositionResponse: res.pos, Clamped: res.clamped}
+    done, _ := json.Marshal(idempotencyRecord{DX: dx, DY: dy, Response: &resp})
+    if err := store.SetString(context.WithoutCancel(ctx), redisKey, string(done), idempotencyTTL); err != nil {
+        slog.ErrorContext(ctx, "Error saving idempotent response", "car_id", id, "error", err)
+    }
+
+    _ = json.NewEncoder(w).Encode(resp)
+}
+
+// releaseOrMarkUnknown handles a failed first move under redisKey. After a
+// lost connection or timeout the move may still have been applied, as
+// moveCar warns, so the key is kept and marked Unknown: releasing it would
+// let the client's retry apply the delta twice. Any other error applied
+// nothing, so the key is released for a retry to try again.
+func releaseOrMarkUnknown(ctx context.Context, id, redisKey string, dx, dy float64, err error) {
+    ctx = context.WithoutCancel(ctx)
+    if isConnError(err) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+        unknown, _ := json.Marshal(idempotencyRecord{DX: dx, DY: dy, Unknown: true})
+        // If this fails too, the pending record stays until it expires
+        if err := store.SetString(ctx, redisKey, string(unknown), idempotencyTTL); err != nil {
+            slog.ErrorContext(ctx, "Error marking idempotent move as unknown", "car_id", id, "error", err)
+        }
+        return
+    }
+    if err := store.Delete(ctx, redisKey); err != nil {
+        slog.ErrorContext(ctx, "Error releasing idempotency key", "car_id", id, "error", err)
+    }
+}
+
+// replayMove answers a request whose Idempotency-Key was already used
+func replayMove(ctx context.Context, w http.ResponseWriter, redisKey string, dx, dy float64) {
+    data, found, err := store.GetString(ctx, redisKey)
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    if !found {
+        // Expired between our SetNX and now; the client can simply retry
+        writeJSONError(w, http.StatusConflict, "Idempotency-Key expired, retry the request")
+        return
+    }
+
+    var record idempotencyRecord
+    if err := json.Unmarshal([]byte(data), &record); err != nil {
+        writeJSONError(w, http.StatusInternalServerError, "malformed idempotency record: "+err.Error())
+        return
+    }
+    if record.DX != dx || record.DY != dy {
+        writeJSONError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different delta")
+        return
+    }
+    if record.Unknown {
+        writeJSONError(w, http.StatusConflict, "a request with this Idempotency-Key failed and may have been applied; read the position before retrying with a new key")
+        return
+    }
+    if record.Response == nil {
+        writeJSONError(w, http.StatusConflict, "a request with this Idempotency-Key is still in progress")
+        return
+    }
+
+    w.Header().Set("Idempotent-Replayed", "true")
+    _ = json.NewEncoder(w).Encode(record.Response)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// -------------------- LAST WRITER -------------------- //
+
+// controllerHeader names the controller making a change, so clients can
+// see who last moved a car. It is informational only; nothing is locked.
+const controllerHeader = "X-Controller-ID"
+
+// Writer recorded for moves made by the velocity ticker
+const tickerWriter = "velocity"
+
+// writerKey is the context key holding the writer of a change
+type writerKey struct{}
+
+// withWriter returns ctx tagged with the controller making its changes
+func withWriter(ctx context.Context, writer string) context.Context {
+    return context.WithValue(ctx, writerKey{}, writer)
+}
+
+// writerFrom returns the writer stored in ctx, or ""
+func writerFrom(ctx context.Context) string {
+    writer, _ := ctx.Value(writerKey{}).(string)
+    return writer
+}
+
+// writerMiddleware tags the request with its controller, and as coming over
+// HTTP, replying 400 if the given ID is invalid
+func writerMiddleware(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        writer, ok := controllerFor(r)
+        if !ok {
+            writeJSONError(w, http.StatusBadRequest, "invalid controller ID")
+            return
+        }
+        next(w, r.WithContext(withSource(withWriter(r.Context(), writer), auditSourceHTTP)))
+    }
+}
+
+// controllerFor returns r's controller ID: X-Controller-ID or, since
+// browsers can't set headers on WebSocket upgrades, ?controller=, falling
+// back to the client's IP. ok is false if a given ID isn't a valid car ID.
+func controllerFor(r *http.Request) (id string, ok bool) {
+    id = r.Header.Get(controllerHeader)
+    if id == "" {
+        id = r.URL.Query().Get("controller")
+    }
+    if id == "" {
+        return clientIP(r), true
+    }
+    return id, carIDPattern.MatchString(id)
+}
+
+// lastWriterKey and lastWriteAtKey return the keys recording who last
+// changed car id and when, in Unix milliseconds
+func lastWriterKey(id string) string {
+    if id == "" {
+        return key("carPosition:lastWriter")
+    }
+    return key("carPosition:" + id + ":lastWriter")
+}
+
+func lastWriteAtKey(id string) string {
+    if id == "" {
+        return key("carPosition:lastWriteAt")
+    }
+    return key("carPosition:" + id + ":lastWriteAt")
+}
+
+// writeInfo is what a change to car id made under ctx records alongside it.
+// Changes with no writer in ctx record nothing.
+func writeInfo(ctx context.Context, id string) map[string]string {
+    writer := writerFrom(ctx)
+    if writer == "" {
+        return nil
+    }
+    return map[string]string{
+        lastWriterKey(id):  writer,
+        lastWriteAtKey(id): strconv.FormatInt(time.Now().UnixMilli(), 10),
+    }
+}
@@ -1,232 +1,3157 @@
-package main
-
-import (
-    "context"
-    "encoding/json"
-    "log"
-    "net/http"
-    "os"
-    "strconv"
-    "sync"
-
-    "github.com/gorilla/mux"
-    "github.com/gorilla/websocket"
-    "github.com/joho/godotenv"
-    "github.com/redis/go-redis/v9"
-)
-
-// -------------------- GLOBALS -------------------- //
-
-// For Redis:
-var ctx = context.Background()
-var rdb *redis.Client
-
-// For managing WebSocket connections:
-var upgrader = websocket.Upgrader{
-    CheckOrigin: func(r *http.Request) bool {
-        return true
-    },
-}
-var wsClients = make(map[*websocket.Conn]bool)
-var wsMutex sync.Mutex // Protects wsClients
-
-// DeltaRequest is the JSON body for incrementing position
-type DeltaRequest struct {
-    Delta int `json:"delta"`
-}
-
-// PositionResponse is how we broadcast the new position
-type PositionResponse struct {
-    Position int `json:"position"`
-}
-
-func main() {
-    if err := godotenv.Load(); err != nil {
-        log.Println("No .env file found (this is fine if running in a production environment with real env vars).")
-    }
-
-    // 2. Read config from environment
-    redisAddr := os.Getenv("REDIS_ADDR")
-    redisPass := os.Getenv("REDIS_PASS") 
-    redisDBStr := os.Getenv("REDIS_DB")  
-    if redisDBStr == "" {
-        redisDBStr = "0"
-    }
-    redisDB, err := strconv.Atoi(redisDBStr)
-    if err != nil {
-        log.Fatalf("Invalid REDIS_DB value: %v", err)
-    }
-
-    // 3. Initialize Redis client using env vars
-    rdb = redis.NewClient(&redis.Options{
-        Addr:     redisAddr,
-        Password: redisPass,
-        DB:       redisDB,
-    })
-
-    // Test Redis connection
-    if err := testRedis(); err != nil {
-        log.Fatal("Could not connect to Redis:", err)
-    }
-
-    // Setup Gorilla Mux
-    r := mux.NewRouter()
-    r.Use(corsMiddleware)
-
-    // Routes
-    r.HandleFunc("/position", getPosition).Methods("GET", "OPTIONS")
-    r.HandleFunc("/position", updatePosition).Methods("POST", "OPTIONS")
-
-    // WebSocket endpoint
-    r.HandleFunc("/ws", wsHandler)
-
-    // Read server port from env or default to "8080"
-    port := os.Getenv("PORT")
-    if port == "" {
-        port = "8080"
-    }
-
-    log.Printf("Server starting on port %s", port)
-    log.Fatal(http.ListenAndServe(":"+port, r))
-}
-
-// testRedis pings Redis to confirm connectivity
-func testRedis() error {
-    _, err := rdb.Ping(ctx).Result()
-    return err
-}
-
-// -------------------- HANDLERS -------------------- //
-
-// getPosition returns the current position from Redis
-func getPosition(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-
-    position, err := rdb.Get(ctx, "carPosition").Int()
-    if err == redis.Nil {
-        // Key doesn't exist; return 0
-        position = 0
-    } else if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
-    }
-
-    _ = json.NewEncoder(w).Encode(PositionResponse{Position: position})
-}
-
-// updatePosition increments the position by Delta in Redis, then broadcasts
-func updatePosition(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-
-    var req DeltaRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    // Atomically increment in Redis
-    newPos, err := rdb.IncrBy(ctx, "carPosition", int64(req.Delta)).Result()
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
-    }
-
-    // Clamp if negative
-    if newPos < 0 {
-        newPos = 0
-        _ = rdb.Set(ctx, "carPosition", 0, 0).Err()
-    }
-
-    broadcastPosition(int(newPos))
-
-    // Return updated position
-    _ = json.NewEncoder(w).Encode(PositionResponse{Position: int(newPos)})
-}
-
-// wsHandler upgrades the connection to a WebSocket and adds it to our clients
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-    conn, err := upgrader.Upgrade(w, r, nil)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
-    }
-
-    // Add this connection to our set of clients
-    wsMutex.Lock()
-    wsClients[conn] = true
-    wsMutex.Unlock()
-
-    log.Println("New WebSocket client connected")
-
-    // Optionally send them the current position
-    go sendCurrentPosition(conn)
-
-    // Read loop (we ignore actual messages)
-    go handleWSRead(conn)
-}
-
-// handleWSRead keeps reading in case the client wants to close or send data
-func handleWSRead(conn *websocket.Conn) {
-    defer func() {
-        wsMutex.Lock()
-        delete(wsClients, conn)
-        wsMutex.Unlock()
-        conn.Close()
-        log.Println("WebSocket client disconnected")
-    }()
-
-    for {
-        if _, _, err := conn.NextReader(); err != nil {
-            break
-        }
-    }
-}
-
-// broadcastPosition sends the given `pos` to all connected WebSocket clients.
-func broadcastPosition(pos int) {
-    msg, _ := json.Marshal(PositionResponse{Position: pos})
-
-    wsMutex.Lock()
-    defer wsMutex.Unlock()
-
-    for clientConn := range wsClients {
-        err := clientConn.WriteMessage(websocket.TextMessage, msg)
-        if err != nil {
-            log.Println("Error writing to WebSocket client:", err)
-            clientConn.Close()
-            delete(wsClients, clientConn)
-        }
-    }
-}
-
-// sendCurrentPosition fetches the current position from Redis and sends it to a single WebSocket connection.
-func sendCurrentPosition(conn *websocket.Conn) {
-    position, err := rdb.Get(ctx, "carPosition").Int()
-    if err == redis.Nil {
-        position = 0
-    } else if err != nil {
-        log.Println("Error reading position:", err)
-        return
-    }
-
-    msg, _ := json.Marshal(PositionResponse{Position: position})
-    if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-        log.Println("Error sending current position to new client:", err)
-    }
-}
-
-// -------------------- MIDDLEWARE -------------------- //
-func corsMiddleware(next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Access-Control-Allow-Origin", "*")
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-        w.Header().Set("Access-Control-Max-Age", "3600")
-
-        if r.Method == http.MethodOptions {
-            w.WriteHeader(http.StatusOK)
-            return
-        }
-        next.ServeHTTP(w, r)
-    })
-}
+package main
+
+import (
+    "compress/flate"
+    "context"
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "math"
+    "math/rand"
+    "net"
+    "net/http"
+    "os"
+    "os/signal"
+    "regexp"
+    "runtime/debug"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+    "github.com/gorilla/websocket"
+    "github.com/redis/go-redis/v9"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "golang.org/x/time/rate"
+)
+
+// -------------------- GLOBALS -------------------- //
+
+// Build info, set at build time with e.g.
+// -ldflags "-X main.Version=1.2.0 -X main.Commit=$(git rev-parse --short HEAD) -X main.BuildTime=$(date -u +%FT%TZ)"
+var (
+    Version   = "dev"
+    Commit    = "dev"
+    BuildTime = "dev"
+)
+
+// For the shared state backend (Redis, or in-memory for local dev):
+var store Store
+var positionSub Subscription // Subscription to positionChannel
+
+// positionChannel carries every position change to all backend instances
+const positionChannel = "position-updates"
+
+// Prepended to every Redis key and channel name, from REDIS_PREFIX (default
+// empty), so several environments or games can share one Redis:
+var redisPrefix = ""
+
+// Whether positions and deltas may have fractions, from POSITION_MODE
+// ("int", the default, or "float"). Float mode stores coordinates with
+// INCRBYFLOAT; integer mode rejects fractional input and uses INCRBY.
+var floatPositions = false
+
+// Most deltas accepted in one POST /position/batch, from BATCH_MAX:
+var batchMax = 100
+
+// Largest accepted request body, from MAX_BODY_BYTES:
+var maxBodyBytes int64 = 64 << 10
+
+// Number of history entries kept per car, from HISTORY_MAX:
+var historyMax int64 = 1000
+
+// defaultHistoryLimit is how many entries /position/history returns without ?limit
+const defaultHistoryLimit = 100
+
+// For managing WebSocket connections:
+var upgrader = websocket.Upgrader{
+    CheckOrigin:  checkOrigin,
+    Subprotocols: []string{"car.v2.msgpack", "car.v2", "car.v1.msgpack", "car.v1"}, // Preferred first
+}
+
+// wsFormat is how a connection's messages are shaped and encoded
+type wsFormat struct {
+    protocol string // "v1" or "v2"
+    encoding string // encodingJSON or encodingMsgpack
+    shape    string // Name in payloadShapes
+}
+
+// Format selected by each subprotocol in upgrader.Subprotocols
+var subprotocolFormats = map[string]wsFormat{
+    "car.v1":         {protocol: "v1", encoding: encodingJSON},
+    "car.v1.msgpack": {protocol: "v1", encoding: encodingMsgpack},
+    "car.v2":         {protocol: "v2", encoding: encodingJSON},
+    "car.v2.msgpack": {protocol: "v2", encoding: encodingMsgpack},
+}
+
+var wsClients = make(map[*websocket.Conn]*wsClient)
+var wsClientsByID = make(map[string]*wsClient) // The same clients, by wsClient.id
+var wsMutex sync.Mutex // Protects wsClients, wsClientsByID, wsPending, wsPerIP and sseClients
+var wsPending int // Connections past the limit check but not yet registered
+var wsPerIP = make(map[string]int) // Registered and pending connections by client IP
+var wsWG sync.WaitGroup // Tracks running writer goroutines, one per connection
+
+// Most WebSocket clients this instance accepts, from MAX_WS_CLIENTS (0 means
+// no limit):
+var maxWSClients = 0
+
+// Most WebSocket clients this instance accepts from one IP, from
+// MAX_WS_PER_IP (0 means no limit), so one client can't use up
+// MAX_WS_CLIENTS:
+var maxWSPerIP = 0
+
+// WebSocket message format for clients that don't ask for a subprotocol,
+// from WS_PROTOCOL: "v1" sends bare position objects, "v2" wraps every
+// message in an Envelope.
+var wsProtocol = "v1"
+
+// What to do when a client's send buffer is full, from WS_BACKPRESSURE:
+// "drop-client" disconnects it (the default), "drop-oldest" discards its
+// oldest queued message to make room.
+var wsBackpressure = "drop-client"
+
+// permessage-deflate level from WS_COMPRESSION, 1 (fastest) to 9 (smallest).
+// 0 disables compression (the default).
+var wsCompressionLevel = 0
+
+// Broadcast coalescing window, from BROADCAST_DEBOUNCE_MS. Changes within a
+// window go out as one broadcast of the latest position at its end; 0 sends
+// every change immediately.
+var broadcastDebounce time.Duration
+var pendingMutex sync.Mutex // Protects pendingPositions and flushScheduled
+var pendingPositions = make(map[string]PositionResponse) // Latest unsent position per car
+var flushScheduled bool
+
+// Artificial lag for frontend testing, from SIMULATE_LATENCY_MS and
+// SIMULATE_JITTER_MS. Both are 0 (off) unless explicitly set.
+var simulatedLatency time.Duration
+var simulatedJitter time.Duration
+
+// For background tasks:
+var tasksWG sync.WaitGroup // Tracks background goroutines stopped on shutdown
+
+// Latest known store connectivity, checked every storeHealthInterval
+// (STORE_HEALTH_INTERVAL) and by /healthz:
+var storeHealthy atomic.Bool
+var storeHealthInterval = 5 * time.Second
+
+// WebSocket keepalive, from WS_PONG_WAIT and WS_PING_INTERVAL. A client that
+// doesn't answer a ping within pongWait is treated as dead.
+var pongWait = 60 * time.Second
+var pingInterval = 30 * time.Second
+
+// Deadline for each WebSocket write, from WS_WRITE_TIMEOUT:
+var writeTimeout = 10 * time.Second
+
+// Largest message a WebSocket client may send, from WS_MAX_MESSAGE_BYTES.
+// Commands are tiny, so a bigger one is refused before it is buffered.
+var wsMaxMessageBytes int64 = 4096
+
+// Bearer token required for write routes and WebSocket moves, from
+// CONTROL_TOKEN (unset means anyone may control the car):
+var controlToken string
+
+// Whether to take client addresses from X-Forwarded-For, from TRUST_PROXY.
+// Only enable it behind a proxy that sets the header, since clients can
+// forge it otherwise.
+var trustProxy = false
+
+// Per-IP token buckets for write routes, sized by Config.RateLimitRPS and
+// Config.RateLimitBurst
+var limiters = make(map[string]*ipLimiter)
+var limitersMutex sync.Mutex // Protects limiters
+
+// Limiters for IPs unseen for limiterTTL are dropped every limiterCleanupInterval
+const (
+    limiterTTL             = 3 * time.Minute
+    limiterCleanupInterval = time.Minute
+)
+
+// ipLimiter is the rate limiter for one client IP
+type ipLimiter struct {
+    limiter  *rate.Limiter
+    lastSeen time.Time
+}
+
+// shutdownTimeout bounds how long we wait for requests and clients on exit
+const shutdownTimeout = 10 * time.Second
+
+// How often one connection may ask for a fresh snapshot with {"type": "sync"}
+const (
+    syncRate  = rate.Limit(1)
+    syncBurst = 3
+)
+
+// sendBufferSize is how many outbound messages a client may have queued
+// before it is considered too slow (see WS_BACKPRESSURE), from
+// BROADCAST_QUEUE_DEPTH
+var sendBufferSize = 64
+
+// wsClient is a connected WebSocket along with its outbound message queue.
+// Only the client's writer goroutine writes to (and closes) conn.
+type wsClient struct {
+    id          string          // Random UUID assigned at connect time
+    remoteAddr  string          // From remoteAddress at upgrade time
+    connectedAt time.Time
+    ip          string          // Host part of remoteAddr, for rate limiting
+    role        string          // roleViewer or roleControl, from the endpoint it connected to
+    controller  string          // Last writer recorded for its moves; see controllerFor
+    protocol    string          // Message format, "v1" or "v2"; see negotiateFormat
+    encoding    string          // encodingJSON or encodingMsgpack; see negotiateFormat
+    shape       string          // Name in payloadShapes; see negotiateFormat
+    compressed  bool            // permessage-deflate was negotiated; see compressionNegotiated
+    conn        *websocket.Conn
+    syncLimit   *rate.Limiter   // Throttles {"type": "sync"} requests
+    shard       int             // Index of the fan-out worker delivering its broadcasts
+    cars        map[string]bool // Car IDs it subscribed to, nil for every car; under wsMutex
+    acks        ackState
+
+    sendMu    sync.Mutex  // Protects sending on and closing send
+    send      chan []byte
+    closed    bool        // send has been closed
+    overflows int         // Messages that found send full, under sendMu
+
+    // Close frame the writer sends once send is closed, if closeCode is set;
+    // see shedClientLocked
+    closeCode      int
+    closeReason    string // closeReasons[closeCode] if empty
+    reconnectAfter time.Duration
+
+    // Guards unregisterClientLocked, which the reader, the writer, shedding
+    // and shutdown may all call for the same client
+    unregister sync.Once
+}
+
+// WebSocket client roles. Viewers connect to /ws and only receive; moves
+// are accepted only from controllers, which connect to /ws/control.
+const (
+    roleViewer  = "viewer"
+    roleControl = "control"
+)
+
+// Redis keys holding each axis of the original car's position. Cars with
+// an ID use carPosition:{id}:x and carPosition:{id}:y.
+const (
+    positionKeyX = "carPosition:x"
+    positionKeyY = "carPosition:y"
+)
+
+// seqKey is incremented, in the same transaction, by every position change
+// of any car. Clients should drop messages whose seq is lower than the
+// highest they have already seen.
+const seqKey = "carPosition:seq"
+
+// carIDPattern is what a valid /cars/{id} ID looks like
+var carIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// DeltaRequest is the JSON body for incrementing position.
+// The legacy {"delta": n} form is treated as an increment to X.
+type DeltaRequest struct {
+    Delta float64 `json:"delta"`
+    DX    float64 `json:"dx"`
+    DY    float64 `json:"dy"`
+    TS    *int64  `json:"ts" validate:"min=0"` // Optional client timestamp; see lastTSKey
+}
+
+// validate checks the move against the live MaxDelta and POSITION_MODE
+func (req DeltaRequest) validate() []FieldError {
+    return deltaErrors(req.DX+req.Delta, req.DY)
+}
+
+// SetPositionRequest is the JSON body for setting an absolute position.
+// Position is an alias for X; axes that are omitted are left unchanged.
+type SetPositionRequest struct {
+    Position *float64 `json:"position"`
+    X        *float64 `json:"x"`
+    Y        *float64 `json:"y"`
+}
+
+// PositionResponse is how we broadcast the new position.
+// Position mirrors X so clients of the 1D API keep working, and ID is only
+// set for cars addressed via /cars/{id}. Coordinates are whole numbers
+// unless POSITION_MODE=float. Heading is in degrees, 0-359. Seq is global
+// across all position changes of all cars (see seqKey).
+// DX and DY are the change a relative move actually made after clamping,
+// with Delta mirroring DX like Position does X; they are 0 in snapshots and
+// after absolute updates.
+type PositionResponse struct {
+    ID       string  `json:"id,omitempty"`
+    Position float64 `json:"position"`
+    X        float64 `json:"x"`
+    Y        float64 `json:"y"`
+    Delta    float64 `json:"delta"`
+    DX       float64 `json:"dx"`
+    DY       float64 `json:"dy"`
+    Heading  int     `json:"heading"`
+    Seq      int64   `json:"seq"`
+    Lap      *int64  `json:"lap,omitempty"` // Only with TRACK_LENGTH; see placeOnTrack
+
+    oldX, oldY float64 // Before the change, for the audit trail; never sent
+}
+
+// ErrorResponse is the JSON body of every error reply. Status repeats the
+// HTTP status code and Value, when set, is the offending input. Errors
+// lists every problem found by validateBody.
+type ErrorResponse struct {
+    Error  string       `json:"error"`
+    Status int          `json:"status"`
+    Value  *float64     `json:"value,omitempty"`
+    Errors []FieldError `json:"errors,omitempty"`
+}
+
+// HealthResponse is returned by /healthz
+type HealthResponse struct {
+    Status  string `json:"status"`
+    Error   string `json:"error,omitempty"`
+    Clients int    `json:"clients"`
+}
+
+// healthCheckTimeout bounds the Redis ping done by /healthz
+const healthCheckTimeout = 2 * time.Second
+
+// requestTimeout bounds the store calls made for one request or WebSocket
+// command, from REQUEST_TIMEOUT
+var requestTimeout = 5 * time.Second
+
+// Longest any HTTP handler may run before the client gets a 503, from
+// HANDLER_TIMEOUT. Long-lived routes are exempt; see longLivedRoutes.
+var handlerTimeout = 15 * time.Second
+
+// Routes that stay open for the life of the connection
+var longLivedRoutes = map[string]bool{
+    "/ws":                        true,
+    "/ws/control":                true,
+    "/position/stream":           true,
+    "/cars/{id}/position/stream": true,
+}
+
+// UpdateResponse is returned by POST /position. Clamped reports that the
+// delta was only partially applied because an axis hit a bound.
+type UpdateResponse struct {
+    PositionResponse
+    Clamped bool `json:"clamped"`
+}
+
+// VersionResponse is returned by GET /version
+type VersionResponse struct {
+    Version   string `json:"version"`
+    Commit    string `json:"commit"`
+    BuildTime string `json:"buildTime"`
+}
+
+// ClientsResponse is returned by GET /clients
+type ClientsResponse struct {
+    Count int `json:"count"`
+}
+
+// ClientDetail describes one connected WebSocket client in GET /clients/detail
+type ClientDetail struct {
+    ID          string    `json:"id"`
+    RemoteAddr  string    `json:"remoteAddr"`
+    ConnectedAt time.Time `json:"connectedAt"`
+    Protocol    string    `json:"protocol"`
+    Encoding    string    `json:"encoding"`
+    Format      string    `json:"format"`
+    Role        string    `json:"role"`
+    Compressed  bool      `json:"compressed"`
+}
+
+// BatchRequest is the JSON body for POST /position/batch; each delta moves X
+type BatchRequest struct {
+    Deltas []float64 `json:"deltas"`
+}
+
+// BatchResponse is returned by POST /position/batch. Applied is the total
+// change made to X, which is less than the sum of deltas when clamped.
+type BatchResponse struct {
+    UpdateResponse
+    Applied float64 `json:"applied"`
+}
+
+// WSCommand is a message sent by a WebSocket client, e.g.
+// {"type": "move", "delta": 1}. Move deltas work like DeltaRequest;
+// {"type": "sync"} asks for the current position again,
+// {"type": "ack", "seq": n} confirms receipt of position n, and
+// {"type": "subscribe", "ids": [...]} picks the cars whose updates it gets.
+type WSCommand struct {
+    Type  string   `json:"type"`
+    Delta float64  `json:"delta"`
+    DX    float64  `json:"dx"`
+    DY    float64  `json:"dy"`
+    Seq   int64    `json:"seq"`
+    IDs   []string `json:"ids"`
+}
+
+// Envelope wraps every outbound WebSocket message in protocol v2
+type Envelope struct {
+    Type string      `json:"type"`
+    Data interface{} `json:"data"`
+}
+
+// HelloMessage is the first v2 message a client receives
+type HelloMessage struct {
+    Version  string `json:"version"`
+    ClientID string `json:"clientId"`
+}
+
+// PresenceMessage announces that a client joined or left. Count is the
+// number of clients connected to this instance afterwards.
+type PresenceMessage struct {
+    Type  string `json:"type"`
+    Event string `json:"event"`
+    ID    string `json:"id"`
+    Count int    `json:"count"`
+}
+
+// HistoryEntry is one recorded position change; TS is Unix milliseconds.
+// Seq keeps otherwise identical entries distinct in the sorted set.
+type HistoryEntry struct {
+    Position float64 `json:"position"`
+    X        float64 `json:"x"`
+    Y        float64 `json:"y"`
+    TS       int64   `json:"ts"`
+    Seq      int64   `json:"seq"`
+}
+
+// newPositionResponse builds a PositionResponse for the given car and coordinates
+func newPositionResponse(id string, x, y float64) PositionResponse {
+    return PositionResponse{ID: id, Position: x, X: x, Y: y}
+}
+
+// setDelta records the change that produced p, keeping Delta in sync with DX
+func (p *PositionResponse) setDelta(dx, dy float64) {
+    p.Delta, p.DX, p.DY = dx, dx, dy
+}
+
+func main() {
+    startTime = time.Now()
+    envErr := loadEnv()
+
+    // 1. Structured JSON logging, level from LOG_LEVEL
+    setupLogger()
+    if envErr != nil {
+        slog.Info("No .env file found (this is fine if running in a production environment with real env vars).")
+    }
+
+    // 2. Read config from environment
+    redisAddr := os.Getenv("REDIS_ADDR")
+    redisPass := os.Getenv("REDIS_PASS") 
+    redisDBStr := os.Getenv("REDIS_DB")  
+    if redisDBStr == "" {
+        redisDBStr = "0"
+    }
+    redisDB, err := strconv.Atoi(redisDBStr)
+    if err != nil {
+        fatal("Invalid REDIS_DB value", "error", err)
+    }
+    redisPrefix = os.Getenv("REDIS_PREFIX")
+
+    // Number type of positions; the bounds below must be valid in it
+    switch mode := os.Getenv("POSITION_MODE"); mode {
+    case "", "int":
+    case "float":
+        floatPositions = true
+    default:
+        fatal("Invalid POSITION_MODE value", "value", mode)
+    }
+
+    // What POST /position's body means: deltas or timed velocities
+    parseMovementMode()
+
+    // Settings SIGHUP can reload: bounds, MAX_DELTA, CORS and rate limits
+    config, err = loadConfig()
+    if err != nil {
+        fatal("Invalid config", "error", err)
+    }
+
+    // One line per HTTP request, as JSON or text
+    switch format := os.Getenv("ACCESS_LOG"); format {
+    case "":
+    case accessLogJSON, accessLogText, accessLogOff:
+        accessLogFormat = format
+    default:
+        fatal("Invalid ACCESS_LOG value", "value", format)
+    }
+
+    // Response compression threshold
+    if gzipStr := os.Getenv("GZIP_MIN_BYTES"); gzipStr != "" {
+        gzipMinBytes, err = strconv.Atoi(gzipStr)
+        if err != nil || gzipMinBytes < 0 {
+            fatal("Invalid GZIP_MIN_BYTES value", "value", gzipStr)
+        }
+    }
+
+    // Largest request body any handler will read
+    if bodyStr := os.Getenv("MAX_BODY_BYTES"); bodyStr != "" {
+        maxBodyBytes, err = strconv.ParseInt(bodyStr, 10, 64)
+        if err != nil || maxBodyBytes <= 0 {
+            fatal("Invalid MAX_BODY_BYTES value", "value", bodyStr)
+        }
+    }
+
+    // Largest batch of queued moves
+    if batchStr := os.Getenv("BATCH_MAX"); batchStr != "" {
+        batchMax, err = strconv.Atoi(batchStr)
+        if err != nil || batchMax <= 0 {
+            fatal("Invalid BATCH_MAX value", "value", batchStr)
+        }
+    }
+
+    // Most cars read by one GET /cars
+    if carsStr := os.Getenv("CARS_MAX"); carsStr != "" {
+        carsMax, err = strconv.Atoi(carsStr)
+        if err != nil || carsMax <= 0 {
+            fatal("Invalid CARS_MAX value", "value", carsStr)
+        }
+    }
+
+    // Length of each car's position history
+    if histStr := os.Getenv("HISTORY_MAX"); histStr != "" {
+        historyMax, err = strconv.ParseInt(histStr, 10, 64)
+        if err != nil || historyMax <= 0 {
+            fatal("Invalid HISTORY_MAX value", "value", histStr)
+        }
+    }
+
+    // Length of the audit trail; 0 turns it off
+    if auditStr := os.Getenv("AUDIT_MAX"); auditStr != "" {
+        auditMax, err = strconv.ParseInt(auditStr, 10, 64)
+        if err != nil || auditMax < 0 {
+            fatal("Invalid AUDIT_MAX value", "value", auditStr)
+        }
+    }
+
+    // Length of each car's change log for catching up by seq
+    if changesStr := os.Getenv("CHANGES_MAX"); changesStr != "" {
+        changesMax, err = strconv.ParseInt(changesStr, 10, 64)
+        if err != nil || changesMax <= 0 {
+            fatal("Invalid CHANGES_MAX value", "value", changesStr)
+        }
+    }
+
+    // Serve HTTPS (and wss://) when both a certificate and key are given
+    tlsCert := os.Getenv("TLS_CERT_FILE")
+    tlsKey := os.Getenv("TLS_KEY_FILE")
+    if (tlsCert == "") != (tlsKey == "") {
+        fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together",
+            "cert_set", tlsCert != "", "key_set", tlsKey != "")
+    }
+
+    // 3. Initialize the store; STORE_BACKEND is "redis" (default) or "memory"
+    backend := os.Getenv("STORE_BACKEND")
+    var ok bool
+    store, ok = newStore(backend, &redis.Options{
+        Addr:     redisAddr,
+        Password: redisPass,
+        DB:       redisDB,
+    })
+    if !ok {
+        fatal("Invalid STORE_BACKEND value", "value", backend)
+    }
+    if backend == "memory" {
+        slog.Warn("Using the in-memory store; state is not shared between instances and is lost on restart")
+    }
+
+    registerMetrics()
+
+    // Test store connection
+    if err := store.Ping(context.Background()); err != nil {
+        fatal("Could not connect to store", "error", err)
+    }
+    storeHealthy.Store(true)
+
+    // Saved car state, restored into an empty store before anything else
+    // writes to it
+    restoreSnapshot()
+
+    // Starting position for a fresh store; existing state always wins
+    if initStr := os.Getenv("INITIAL_POSITION"); initStr != "" {
+        initial, err := strconv.ParseFloat(initStr, 64)
+        if err != nil || !representable(initial) {
+            fatal("Invalid INITIAL_POSITION value", "value", initStr)
+        }
+        if _, clamped := clampPosition(initial); clamped {
+            fatal("INITIAL_POSITION is out of bounds", "value", initStr, "error", boundsError())
+        }
+        initPosition(initial)
+    }
+
+    // Optional lap wrapping of X, for racing
+    parseTrackLength()
+
+    // WebSocket message format
+    if proto := os.Getenv("WS_PROTOCOL"); proto != "" {
+        if proto != "v1" && proto != "v2" {
+            fatal("Invalid WS_PROTOCOL value", "value", proto)
+        }
+        wsProtocol = proto
+    }
+
+    // Default payload shape of position messages
+    if shape := os.Getenv("BROADCAST_FORMAT"); shape != "" {
+        if _, ok := payloadShapes[shape]; !ok {
+            fatal("Invalid BROADCAST_FORMAT value", "value", shape)
+        }
+        broadcastShape = shape
+    }
+
+    // Cap on concurrent WebSocket clients
+    if maxStr := os.Getenv("MAX_WS_CLIENTS"); maxStr != "" {
+        maxWSClients, err = strconv.Atoi(maxStr)
+        if err != nil || maxWSClients < 0 {
+            fatal("Invalid MAX_WS_CLIENTS value", "value", maxStr)
+        }
+    }
+    if perIPStr := os.Getenv("MAX_WS_PER_IP"); perIPStr != "" {
+        maxWSPerIP, err = strconv.Atoi(perIPStr)
+        if err != nil || maxWSPerIP < 0 {
+            fatal("Invalid MAX_WS_PER_IP value", "value", perIPStr)
+        }
+    }
+
+    // Lag reporting for clients that ack positions
+    if lagStr := os.Getenv("ACK_LAG_THRESHOLD"); lagStr != "" {
+        ackLagThreshold, err = strconv.ParseInt(lagStr, 10, 64)
+        if err != nil || ackLagThreshold <= 0 {
+            fatal("Invalid ACK_LAG_THRESHOLD value", "value", lagStr)
+        }
+    }
+    ackTimeout = durationFromEnv("ACK_TIMEOUT", ackTimeout)
+
+    // Broadcast delivery
+    if workersStr := os.Getenv("BROADCAST_WORKERS"); workersStr != "" {
+        broadcastWorkers, err = strconv.Atoi(workersStr)
+        if err != nil || broadcastWorkers <= 0 {
+            fatal("Invalid BROADCAST_WORKERS value", "value", workersStr)
+        }
+    }
+    startFanOutWorkers()
+
+    // Slow client handling
+    if policy := os.Getenv("WS_BACKPRESSURE"); policy != "" {
+        if policy != "drop-client" && policy != "drop-oldest" {
+            fatal("Invalid WS_BACKPRESSURE value", "value", policy)
+        }
+        wsBackpressure = policy
+    }
+    if depthStr := os.Getenv("BROADCAST_QUEUE_DEPTH"); depthStr != "" {
+        sendBufferSize, err = strconv.Atoi(depthStr)
+        if err != nil || sendBufferSize <= 0 {
+            fatal("Invalid BROADCAST_QUEUE_DEPTH value", "value", depthStr)
+        }
+    }
+
+    // WebSocket keepalive tuning
+    pongWait = durationFromEnv("WS_PONG_WAIT", pongWait)
+    pingInterval = durationFromEnv("WS_PING_INTERVAL", pingInterval)
+    writeTimeout = durationFromEnv("WS_WRITE_TIMEOUT", writeTimeout)
+    if pingInterval >= pongWait {
+        fatal("WS_PING_INTERVAL must be shorter than WS_PONG_WAIT",
+            "ping_interval", pingInterval.String(), "pong_wait", pongWait.String())
+    }
+
+    // Cap on inbound WebSocket messages
+    if maxMsgStr := os.Getenv("WS_MAX_MESSAGE_BYTES"); maxMsgStr != "" {
+        wsMaxMessageBytes, err = strconv.ParseInt(maxMsgStr, 10, 64)
+        if err != nil || wsMaxMessageBytes <= 0 {
+            fatal("Invalid WS_MAX_MESSAGE_BYTES value", "value", maxMsgStr)
+        }
+    }
+
+    // WebSocket I/O buffers; 0 keeps the upgrader's 4KB default
+    for _, buf := range []struct {
+        name string
+        size *int
+    }{{"WS_READ_BUFFER", &upgrader.ReadBufferSize}, {"WS_WRITE_BUFFER", &upgrader.WriteBufferSize}} {
+        if sizeStr := os.Getenv(buf.name); sizeStr != "" {
+            size, err := strconv.Atoi(sizeStr)
+            if err != nil || size < 0 {
+                fatal("Invalid buffer size", "var", buf.name, "value", sizeStr)
+            }
+            *buf.size = size
+        }
+    }
+
+    // permessage-deflate level; 0 leaves compression off
+    if levelStr := os.Getenv("WS_COMPRESSION"); levelStr != "" {
+        wsCompressionLevel, err = strconv.Atoi(levelStr)
+        if err != nil || wsCompressionLevel < 0 || wsCompressionLevel > flate.BestCompression {
+            fatal("Invalid WS_COMPRESSION value", "value", levelStr)
+        }
+        upgrader.EnableCompression = wsCompressionLevel > 0
+    }
+
+    // Optional coalescing of bursts of broadcasts
+    if debounceStr := os.Getenv("BROADCAST_DEBOUNCE_MS"); debounceStr != "" {
+        ms, err := strconv.Atoi(debounceStr)
+        if err != nil || ms < 0 {
+            fatal("Invalid BROADCAST_DEBOUNCE_MS value", "value", debounceStr)
+        }
+        broadcastDebounce = time.Duration(ms) * time.Millisecond
+    }
+
+    // Simulated latency, for testing only
+    for _, lag := range []struct {
+        name string
+        dst  *time.Duration
+    }{{"SIMULATE_LATENCY_MS", &simulatedLatency}, {"SIMULATE_JITTER_MS", &simulatedJitter}} {
+        if msStr := os.Getenv(lag.name); msStr != "" {
+            ms, err := strconv.Atoi(msStr)
+            if err != nil || ms < 0 {
+                fatal("Invalid milliseconds value", "var", lag.name, "value", msStr)
+            }
+            *lag.dst = time.Duration(ms) * time.Millisecond
+        }
+    }
+    if simulatedLatency > 0 || simulatedJitter > 0 {
+        slog.Warn("SIMULATED LATENCY IS ENABLED; every response and broadcast is delayed. Do not use in production.",
+            "latency", simulatedLatency.String(), "jitter", simulatedJitter.String())
+    }
+
+    // Only holders of the control token may move the car
+    controlToken = os.Getenv("CONTROL_TOKEN")
+    if proxyStr := os.Getenv("TRUST_PROXY"); proxyStr != "" {
+        trustProxy, err = strconv.ParseBool(proxyStr)
+        if err != nil {
+            fatal("Invalid TRUST_PROXY value", "value", proxyStr)
+        }
+    }
+    if controlToken == "" {
+        slog.Warn("CONTROL_TOKEN is not set; anyone can move the car")
+    }
+
+    if repairStr := os.Getenv("AUTO_REPAIR"); repairStr != "" {
+        autoRepair, err = strconv.ParseBool(repairStr)
+        if err != nil {
+            fatal("Invalid AUTO_REPAIR value", "value", repairStr)
+        }
+    }
+
+    // Test-only routes, for setting up E2E scenarios
+    parseTestMode()
+
+    // Start frozen, e.g. to bring up a replica mid-migration
+    if maintStr := os.Getenv("MAINTENANCE_MODE"); maintStr != "" {
+        enabled, err := strconv.ParseBool(maintStr)
+        if err != nil {
+            fatal("Invalid MAINTENANCE_MODE value", "value", maintStr)
+        }
+        maintenanceMode.Store(enabled)
+        if enabled {
+            slog.Warn("Starting in maintenance mode; the car is read-only")
+        }
+    }
+
+    go cleanupLimiters()
+
+    // Fan out position changes from every instance to our local clients
+    if err := startSubscriber(); err != nil {
+        fatal("Could not subscribe to position updates", "error", err)
+    }
+    if err := startNoticeSubscriber(); err != nil {
+        fatal("Could not subscribe to notices", "error", err)
+    }
+
+    // Background tasks, stopped on shutdown
+    tickInterval = millisFromEnv("TICK_MS", tickInterval)
+    storeHealthInterval = durationFromEnv("STORE_HEALTH_INTERVAL", storeHealthInterval)
+    requestTimeout = durationFromEnv("REQUEST_TIMEOUT", requestTimeout)
+    handlerTimeout = durationFromEnv("HANDLER_TIMEOUT", handlerTimeout)
+    pollTimeout = durationFromEnv("POLL_TIMEOUT", pollTimeout)
+    if pollTimeout >= handlerTimeout {
+        fatal("POLL_TIMEOUT must be shorter than HANDLER_TIMEOUT",
+            "poll_timeout", pollTimeout.String(), "handler_timeout", handlerTimeout.String())
+    }
+    idempotencyTTL = durationFromEnv("IDEMPOTENCY_TTL", idempotencyTTL)
+    if attemptsStr := os.Getenv("STORE_RETRY_ATTEMPTS"); attemptsStr != "" {
+        storeRetryAttempts, err = strconv.Atoi(attemptsStr)
+        if err != nil || storeRetryAttempts < 1 {
+            fatal("Invalid STORE_RETRY_ATTEMPTS value", "value", attemptsStr)
+        }
+    }
+    storeRetryDelay = durationFromEnv("STORE_RETRY_DELAY", storeRetryDelay)
+    loadReplay()
+    taskCtx, stopTasks := context.WithCancel(context.Background())
+    tasksWG.Add(2)
+    go runVelocityTicker(taskCtx)
+    go monitorStore(taskCtx)
+    if replaySteps != nil {
+        tasksWG.Add(1)
+        go runReplay(taskCtx)
+    }
+    if snapshotFile != "" {
+        tasksWG.Add(1)
+        go runSnapshots(taskCtx)
+    }
+
+    r := newRouter()
+
+    // Read server port from env or default to "8080"
+    port := os.Getenv("PORT")
+    if port == "" {
+        port = "8080"
+    }
+
+    // LISTEN_ADDR (host:port) overrides PORT, e.g. to bind to 127.0.0.1 only
+    addr := ":" + port
+    if listenAddr := os.Getenv("LISTEN_ADDR"); listenAddr != "" {
+        if _, _, err := net.SplitHostPort(listenAddr); err != nil {
+            fatal("Invalid LISTEN_ADDR value", "value", listenAddr, "error", err)
+        }
+        addr = listenAddr
+    }
+
+    // One line with everything that took effect, secrets redacted
+    positionMode := "int"
+    if floatPositions {
+        positionMode = "float"
+    }
+    if backend == "" {
+        backend = "redis"
+    }
+    slog.Info("Effective configuration", "config", startupConfig{
+        Addr:         addr,
+        TLS:          tlsCert != "",
+        StoreBackend: backend,
+        RedisAddr:    redisAddr,
+        RedisDB:      redisDB,
+        RedisPrefix:  redisPrefix,
+        RedisPass:    redisPass,
+        ControlToken: controlToken,
+        PositionMode: positionMode,
+        Config:       currentConfig(),
+    })
+
+    server := &http.Server{
+        Addr:    addr,
+        Handler: r,
+    }
+    server.RegisterOnShutdown(closeAllStreams)
+    server.RegisterOnShutdown(closeAllPolls)
+
+    // Stop on SIGINT/SIGTERM
+    stop := make(chan os.Signal, 1)
+    signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+    // Reload Config on SIGHUP, keeping every connection open
+    reload := make(chan os.Signal, 1)
+    signal.Notify(reload, syscall.SIGHUP)
+    go func() {
+        for range reload {
+            reloadConfig()
+        }
+    }()
+
+    go func() {
+        var err error
+        if tlsCert != "" {
+            slog.Info("Server starting", "addr", addr, "tls", true)
+            err = server.ListenAndServeTLS(tlsCert, tlsKey)
+        } else {
+            slog.Info("Server starting", "addr", addr, "tls", false)
+            err = server.ListenAndServe()
+        }
+        if err != nil && err != http.ErrServerClosed {
+            fatal("Server failed", "error", err)
+        }
+    }()
+
+    sig := <-stop
+    slog.Info("Shutting down", "signal", sig.String())
+
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+    defer cancel()
+    shutdown(shutdownCtx, server, stopTasks)
+}
+
+// shutdown stops accepting HTTP requests, waits for in-flight ones, stops
+// background tasks, closes every WebSocket client and finally the store
+// client, all bounded by ctx.
+func shutdown(ctx context.Context, server *http.Server, stopTasks context.CancelFunc) {
+    if err := server.Shutdown(ctx); err != nil {
+        slog.Error("Error shutting down HTTP server", "error", err)
+    }
+
+    stopTasks()
+    stopBroadcasts()
+
+    // Hijacked WebSocket connections aren't tracked by server.Shutdown
+    closeAllClients()
+
+    done := make(chan struct{})
+    go func() {
+        tasksWG.Wait()
+        wsWG.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-ctx.Done():
+        slog.Warn("Timed out waiting for background tasks and WebSocket writers to finish")
+    }
+
+    if err := positionSub.Close(); err != nil {
+        slog.Error("Error closing position subscription", "error", err)
+    }
+    if err := noticeSub.Close(); err != nil {
+        slog.Error("Error closing notice subscription", "error", err)
+    }
+
+    if err := store.Close(); err != nil {
+        slog.Error("Error closing store", "error", err)
+    }
+    slog.Info("Server stopped")
+}
+
+// setupLogger installs a JSON slog handler as the default logger. LOG_LEVEL
+// may be debug, info, warn or error (default info).
+func setupLogger() {
+    var level slog.Level
+    levelStr := os.Getenv("LOG_LEVEL")
+    if levelStr == "" {
+        levelStr = "info"
+    }
+    if err := level.UnmarshalText([]byte(levelStr)); err != nil {
+        slog.Error("Invalid LOG_LEVEL value", "value", levelStr)
+        os.Exit(1)
+    }
+    handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+    slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// fatal logs msg at error level and exits
+func fatal(msg string, args ...any) {
+    slog.Error(msg, args...)
+    os.Exit(1)
+}
+
+// durationFromEnv parses a duration such as "30s" from the named env var,
+// returning def when it is unset.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+    str := os.Getenv(name)
+    if str == "" {
+        return def
+    }
+    d, err := time.ParseDuration(str)
+    if err != nil || d <= 0 {
+        fatal("Invalid duration", "var", name, "value", str)
+    }
+    return d
+}
+
+// millisFromEnv parses a whole number of milliseconds from the named env
+// var, returning def when it is unset.
+func millisFromEnv(name string, def time.Duration) time.Duration {
+    str := os.Getenv(name)
+    if str == "" {
+        return def
+    }
+    ms, err := strconv.Atoi(str)
+    if err != nil || ms <= 0 {
+        fatal("Invalid milliseconds value", "var", name, "value", str)
+    }
+    return time.Duration(ms) * time.Millisecond
+}
+
+// splitList splits a comma-separated env value, trimming spaces and
+// skipping empty entries.
+func splitList(str string) []string {
+    var items []string
+    for _, item := range strings.Split(str, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+// startSubscriber subscribes to positionChannel and broadcasts each received
+// position to this instance's clients. Handlers only publish, so every
+// instance (including the one that made the change) broadcasts exactly once.
+func startSubscriber() error {
+    var err error
+    // Lives until shutdown, so it isn't tied to any request
+    positionSub, err = store.Subscribe(context.Background(), key(positionChannel))
+    if err != nil {
+        return err
+    }
+
+    go func() {
+        messages, resumed := positionSub.Messages(), positionSub.Resumed()
+        for {
+            select {
+            case payload, ok := <-messages:
+                if !ok {
+                    return
+                }
+                var pos PositionResponse
+                if err := json.Unmarshal(payload, &pos); err != nil {
+                    slog.Error("Error decoding position update", "error", err)
+                    continue
+                }
+                broadcastPosition(broadcastCtx, pos)
+            case <-resumed:
+                resyncPositions()
+            }
+        }
+    }()
+    return nil
+}
+
+// Cars this instance has broadcast, so resyncPositions knows what to refetch
+var broadcastCars sync.Map
+
+// resyncPositions rebroadcasts the current position of every car we know
+// of, after the subscription comes back from an outage during which
+// updates may have been missed
+func resyncPositions() {
+    ids := []string{""}
+    broadcastCars.Range(func(id, _ interface{}) bool {
+        if id != "" {
+            ids = append(ids, id.(string))
+        }
+        return true
+    })
+
+    for _, id := range ids {
+        ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+        pos, err := readPosition(ctx, id)
+        cancel()
+        if err != nil {
+            slog.Error("Error refetching position after resubscribing", "car_id", id, "error", err)
+            continue
+        }
+        broadcastPosition(broadcastCtx, pos)
+    }
+    slog.Info("Rebroadcast positions after resubscribing", "cars", len(ids))
+}
+
+// monitorStore pings the store every storeHealthInterval so outages and
+// recoveries show up in the logs even when no requests are coming in
+func monitorStore(ctx context.Context) {
+    defer tasksWG.Done()
+
+    ticker := time.NewTicker(storeHealthInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            pingCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+            recordStoreHealth(store.Ping(pingCtx))
+            cancel()
+        }
+    }
+}
+
+// recordStoreHealth updates the latest known store state, logging transitions
+func recordStoreHealth(err error) {
+    healthy := err == nil
+    if storeHealthy.Swap(healthy) == healthy {
+        return
+    }
+    if healthy {
+        slog.Info("Store connection recovered")
+    } else {
+        slog.Error("Store connection lost", "error", err)
+    }
+}
+
+// initPosition sets the original car's X to initial unless the store
+// already has one, so restarts keep the car where it was
+func initPosition(initial float64) {
+    ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+    defer cancel()
+
+    xKey, _ := positionKeys("")
+    set, err := store.SetNX(ctx, xKey, formatFloat(initial), 0)
+    if err != nil {
+        fatal("Could not set initial position", "error", err)
+    }
+    if set {
+        slog.Info("Initialized car position", "position", initial)
+    } else {
+        slog.Info("Keeping existing car position; INITIAL_POSITION only applies to a fresh store", "initial_position", initial)
+    }
+}
+
+// withReconnectRetry runs op for a handler: through withRetry with
+// STORE_RETRY_ATTEMPTS when it fails with a connection error, e.g. while
+// Redis is restarting, and once more after repairing a corrupted value with
+// AUTO_REPAIR
+func withReconnectRetry(ctx context.Context, op func(context.Context) error) error {
+    err := withRetry(ctx, storeRetryAttempts, op)
+    if repairCorruption(ctx, err) {
+        err = withRetry(ctx, storeRetryAttempts, op)
+    }
+    return err
+}
+
+// isConnError reports whether err means the connection to the store broke,
+// as opposed to e.g. a bad value
+func isConnError(err error) bool {
+    var netErr net.Error
+    return errors.Is(err, io.EOF) ||
+        errors.Is(err, io.ErrUnexpectedEOF) ||
+        errors.Is(err, syscall.ECONNREFUSED) ||
+        errors.Is(err, syscall.ECONNRESET) ||
+        errors.Is(err, syscall.EPIPE) ||
+        errors.As(err, &netErr)
+}
+
+// publishPosition appends a position change to the car's history and
+// announces it to every instance. If the store won't take the message we
+// still update our own clients.
+func publishPosition(ctx context.Context, pos PositionResponse) {
+    publishPositionWith(ctx, store.Pipeline(), pos)
+}
+
+// publishPositionWith is publishPosition sending the writes already queued
+// on pipe in the same round trip, ahead of the history and the message
+func publishPositionWith(ctx context.Context, pipe Pipeline, pos PositionResponse) {
+    // The change is already stored, so announce it even if the caller hangs up
+    ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), requestTimeout)
+    defer cancel()
+
+    positionUpdatesTotal.Inc()
+    positionUpdatesCount.Add(1)
+    ts := time.Now().UnixMilli()
+    entry, ok := marshalMessage(ctx, "history", HistoryEntry{
+        Position: pos.Position,
+        X:        pos.X,
+        Y:        pos.Y,
+        TS:       ts,
+        Seq:      pos.Seq,
+    })
+    var historyErr, changesErr, publishErr func() error
+    if ok {
+        historyErr = pipe.AddScored(ctx, historyKey(pos.ID), string(entry), float64(ts), historyMax)
+    }
+    auditErr := queueAudit(ctx, pipe, pos, ts)
+    msg, ok := marshalMessage(ctx, "position", pos)
+    if ok {
+        // One more than the window; see getChanges
+        changesErr = pipe.AddScored(ctx, changesKey(pos.ID), string(msg), float64(pos.Seq), changesMax+1)
+        publishErr = pipe.Publish(ctx, key(positionChannel), msg)
+    }
+    _ = pipe.Exec(ctx) // Each write's error is checked below
+
+    if historyErr != nil {
+        if err := historyErr(); err != nil {
+            slog.ErrorContext(ctx, "Error recording position history", "car_id", pos.ID, "error", err)
+        }
+    }
+    if changesErr != nil {
+        if err := changesErr(); err != nil {
+            slog.ErrorContext(ctx, "Error recording position change", "car_id", pos.ID, "error", err)
+        }
+    }
+    if auditErr != nil {
+        if err := auditErr(); err != nil {
+            slog.ErrorContext(ctx, "Error recording audit entry", "car_id", pos.ID, "error", err)
+        }
+    }
+    if publishErr != nil {
+        if err := publishErr(); err != nil {
+            slog.ErrorContext(ctx, "Error publishing position update", "car_id", pos.ID, "error", err)
+            broadcastPosition(broadcastCtx, pos)
+        }
+    }
+}
+
+// -------------------- HANDLERS -------------------- //
+
+// carIDFromRequest returns the {id} route variable, or "" for the legacy
+// single-car routes. ok is false when an ID is present but invalid.
+func carIDFromRequest(r *http.Request) (id string, ok bool) {
+    id, present := mux.Vars(r)["id"]
+    if !present {
+        return "", true
+    }
+    return id, carIDPattern.MatchString(id)
+}
+
+// key namespaces a Redis key or channel name with redisPrefix. Every name
+// the server touches goes through it.
+func key(name string) string {
+    return redisPrefix + name
+}
+
+// positionKeys returns the Redis keys holding each axis of the given car.
+// The empty ID is the original single car.
+func positionKeys(id string) (xKey, yKey string) {
+    if id == "" {
+        return key(positionKeyX), key(positionKeyY)
+    }
+    return key("carPosition:" + id + ":x"), key("carPosition:" + id + ":y")
+}
+
+// decodeBody decodes r's JSON body into dst. It replies 413 and returns
+// false if the body exceeds maxBodyBytes, and 400 if it is malformed or has
+// fields dst doesn't know, so typos don't go unnoticed.
+func decodeBody(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+    r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+    dec := json.NewDecoder(r.Body)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(dst); err != nil {
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            writeJSONError(w, http.StatusRequestEntityTooLarge,
+                fmt.Sprintf("request body must not exceed %d bytes", maxBodyBytes))
+            return false
+        }
+        writeJSONError(w, http.StatusBadRequest, err.Error())
+        return false
+    }
+    return true
+}
+
+// writeJSONError replies with an ErrorResponse carrying msg and status
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+    writeErrorResponse(w, ErrorResponse{Error: msg, Status: status})
+}
+
+// writeErrorResponse replies with resp as JSON, using resp.Status as the HTTP status
+func writeErrorResponse(w http.ResponseWriter, resp ErrorResponse) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(resp.Status)
+    _ = json.NewEncoder(w).Encode(resp)
+}
+
+// readPosition fetches both axes and the heading of a car and the current
+// sequence number from the store in one round-trip.
+// Missing keys are treated as 0.
+func readPosition(ctx context.Context, id string) (PositionResponse, error) {
+    xKey, yKey := positionKeys(id)
+    vals, err := store.GetFloat(ctx, xKey, yKey, headingKey(id), key(seqKey), lapsKey(id))
+    if err != nil {
+        return PositionResponse{}, err
+    }
+    pos := newPositionResponse(id, vals[0], vals[1])
+    pos.Heading = normalizeHeading(int64(vals[2]))
+    pos.Seq = int64(vals[3])
+    pos.placeOnTrack(vals[4])
+    return pos, nil
+}
+
+// lastTSKey returns the Redis key holding the newest client timestamp of a
+// move applied to car id. It is advanced in the same step as the move, so a
+// move that fails, or a replayed one, never advances it.
+func lastTSKey(id string) string {
+    if id == "" {
+        return key("carPosition:lastTs")
+    }
+    return key("carPosition:" + id + ":lastTs")
+}
+
+// errStaleMove is returned for a move stamped older than the last applied one
+var errStaleMove = errors.New("ts is older than the last applied move")
+
+// moveTSKey is the context key holding the client timestamp of a move
+type moveTSKey struct{}
+
+// withMoveTS returns ctx tagged with the client timestamp of its move, which
+// applyDelta then only applies if ts is not older than lastTSKey's
+func withMoveTS(ctx context.Context, ts int64) context.Context {
+    return context.WithValue(ctx, moveTSKey{}, ts)
+}
+
+// moveTSFrom returns the move timestamp stored in ctx, with ok false if
+// there is none
+func moveTSFrom(ctx context.Context) (ts int64, ok bool) {
+    ts, ok = ctx.Value(moveTSKey{}).(int64)
+    return ts, ok
+}
+
+// writeMoveError replies to a move that failed with err: 409 with the
+// rejected ts if it was stale, 500 otherwise
+func writeMoveError(ctx context.Context, w http.ResponseWriter, err error) {
+    if !errors.Is(err, errStaleMove) {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    ts, _ := moveTSFrom(ctx)
+    value := float64(ts)
+    writeErrorResponse(w, ErrorResponse{
+        Error:  err.Error(),
+        Status: http.StatusConflict,
+        Value:  &value,
+    })
+}
+
+// historyKey returns the Redis sorted set holding the given car's position
+// history, scored by timestamp. It was once a list under ":history", hence
+// the new name.
+func historyKey(id string) string {
+    if id == "" {
+        return key("carPosition:timeline")
+    }
+    return key("carPosition:" + id + ":timeline")
+}
+
+// requestContext returns the context for r's store calls. It ends when the
+// client hangs up or after requestTimeout, whichever comes first.
+func requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+    return context.WithTimeout(r.Context(), requestTimeout)
+}
+
+// getPosition returns the current position from Redis
+func getPosition(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+
+    var pos PositionResponse
+    err := withReconnectRetry(ctx, func(ctx context.Context) (err error) {
+        pos, err = readPosition(ctx, id)
+        return err
+    })
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    _ = json.NewEncoder(w).Encode(pos)
+}
+
+// updatePosition increments the position by (DX, DY) in Redis, then broadcasts
+func updatePosition(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+
+    var req DeltaRequest
+    if !decodeBody(w, r, &req) || !validateBody(w, &req) {
+        return
+    }
+    dx := req.DX + req.Delta
+    dy := req.DY
+
+    // ?dryRun=true only reports where the move would land
+    move := moveCar
+    dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+    if dryRun {
+        move = previewDelta
+    }
+
+    // Moves stamped older than the last stamped move are stale, e.g. queued
+    // by a laggy client, and would undo newer progress. The move checks its
+    // ts as it is applied, so a replay of an applied move still gets its
+    // first response.
+    if req.TS != nil && !dryRun {
+        ctx = withMoveTS(ctx, *req.TS)
+    }
+
+    // Retries carrying the same Idempotency-Key are applied only once
+    if key := r.Header.Get(idempotencyHeader); key != "" && !dryRun {
+        if len(key) > maxIdempotencyKeyLen {
+            writeJSONError(w, http.StatusBadRequest, "Idempotency-Key is too long")
+            return
+        }
+        moveOnce(ctx, w, id, key, dx, dy)
+        return
+    }
+
+    res, err := move(ctx, id, dx, dy)
+    if err != nil {
+        writeMoveError(ctx, w, err)
+        return
+    }
+
+    // Return updated position
+    _ = json.NewEncoder(w).Encode(UpdateResponse{
+        PositionResponse: res.pos,
+        Clamped:          res.clamped,
+    })
+}
+
+// validateDelta rejects no-ops and deltas that can only be bugs, returning
+// the 400 to send, or nil if (dx, dy) is acceptable
+func validateDelta(dx, dy float64) *ErrorResponse {
+    if errs := deltaErrors(dx, dy); len(errs) > 0 {
+        resp := fieldErrorResponse(errs)
+        return &resp
+    }
+    return nil
+}
+
+// deltaErrors lists everything wrong with a move of (dx, dy)
+func deltaErrors(dx, dy float64) []FieldError {
+    if dx == 0 && dy == 0 {
+        return []FieldError{{Field: "delta", Error: "delta must not be zero"}}
+    }
+    var errs []FieldError
+    maxDelta := currentConfig().MaxDelta
+    for _, d := range []struct {
+        name  string
+        value float64
+    }{{"dx", dx}, {"dy", dy}} {
+        value := d.value
+        if !representable(d.value) {
+            errs = append(errs, FieldError{Field: d.name, Error: d.name + " must be a whole number", Value: &value})
+        }
+        if d.value > float64(maxDelta) || d.value < -float64(maxDelta) {
+            errs = append(errs, FieldError{
+                Field: d.name,
+                Error: fmt.Sprintf("%s must be between %d and %d", d.name, -maxDelta, maxDelta),
+                Value: &value,
+            })
+        }
+    }
+    return errs
+}
+
+// moveCar applies a validated move from a controller, over HTTP or WebSocket.
+// A reply lost to a dropped connection may hide an applied first attempt;
+// we accept that rare double move over failing every request during a Redis restart.
+func moveCar(ctx context.Context, id string, dx, dy float64) (res deltaResult, err error) {
+    err = withReconnectRetry(ctx, func(ctx context.Context) error {
+        res, err = applyDelta(ctx, id, dx, dy)
+        return err
+    })
+    return res, err
+}
+
+// deltaResult is the outcome of applyDelta
+type deltaResult struct {
+    pos                PositionResponse
+    appliedX, appliedY float64 // Change actually made to each axis, after clamping
+    clamped            bool    // Whether a bound was hit
+}
+
+// applyDelta atomically moves car id by (dx, dy), after deltaTransform,
+// clamps the result into bounds and publishes it.
+func applyDelta(ctx context.Context, id string, dx, dy float64) (deltaResult, error) {
+    dx, dy, err := transformDelta(ctx, id, dx, dy)
+    if err != nil {
+        return deltaResult{}, err
+    }
+
+    // Atomically increment both axes and the sequence number, reading the
+    // heading and any laps
+    xKey, yKey := positionKeys(id)
+    incr := stateIncrements(id, map[string]float64{xKey: dx, yKey: dy})
+    var vals map[string]float64
+    if ts, ok := moveTSFrom(ctx); ok {
+        // The ts is advanced in the same step, only if the move is applied
+        var fresh bool
+        vals, fresh, err = store.IncrByFloatIfNewer(ctx, lastTSKey(id), ts, incr, writeInfo(ctx, id))
+        if err == nil && !fresh {
+            err = errStaleMove
+        }
+    } else {
+        vals, err = incrNumbers(ctx, incr, writeInfo(ctx, id))
+    }
+    if err != nil {
+        return deltaResult{}, err
+    }
+    return settleDelta(ctx, id, dx, dy, vals), nil
+}
+
+// settleDelta clamps (or wraps) car id once an increment of (dx, dy) has
+// left it at vals, as read back by stateIncrements, and publishes it
+func settleDelta(ctx context.Context, id string, dx, dy float64, vals map[string]float64) deltaResult {
+    xKey, yKey := positionKeys(id)
+    lKey := lapsKey(id)
+    newX, newY := vals[xKey], vals[yKey]
+    oldX, oldY := newX-dx, newY-dy
+    slog.InfoContext(ctx, "Position updated",
+        "car_id", id,
+        "dx", dx, "dy", dy,
+        "old_x", oldX, "old_y", oldY,
+        "new_x", newX, "new_y", newY)
+
+    // The move is applied; don't let a cancelled request skip the clamp
+    ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), requestTimeout)
+    defer cancel()
+
+    // Clamp each axis into bounds. The corrected values depend on the
+    // increment's result, so they are written after it, but in the same
+    // round trip as the history and publish, and ahead of them.
+    // On a track X wraps instead, by adding to it and the laps rather than
+    // setting them, so concurrent wraps add up too.
+    pipe := store.Pipeline()
+    clampedX, xClamped := clampPosition(newX)
+    clampedY, yClamped := clampPosition(newY)
+    var wrapErr func() error
+    if trackLength > 0 {
+        clampedX, xClamped = newX, false
+        if laps := lapsCrossed(oldX, newX); laps != 0 {
+            wrapErr = queueIncrNumbers(ctx, pipe, map[string]float64{
+                xKey: -float64(laps) * trackLength,
+                lKey: float64(laps),
+            })
+        }
+    }
+    fix := make(map[string]float64, 2)
+    if xClamped {
+        fix[xKey] = clampedX
+    }
+    if yClamped {
+        fix[yKey] = clampedY
+    }
+    var fixErr func() error
+    if len(fix) > 0 {
+        fixErr = queueSetNumbers(ctx, pipe, fix)
+    }
+
+    pos := newPositionResponse(id, clampedX, clampedY)
+    pos.Heading = normalizeHeading(int64(vals[headingKey(id)]))
+    pos.Seq = int64(vals[key(seqKey)])
+    pos.setDelta(clampedX-oldX, clampedY-oldY)
+    pos.oldX, pos.oldY = oldX, oldY
+    pos.placeOnTrack(vals[lKey])
+    publishPositionWith(ctx, pipe, pos)
+    if fixErr != nil {
+        if err := fixErr(); err != nil {
+            slog.ErrorContext(ctx, "Error storing clamped position", "car_id", id, "error", err)
+        }
+    }
+    if wrapErr != nil {
+        if err := wrapErr(); err != nil {
+            slog.ErrorContext(ctx, "Error storing wrapped position", "car_id", id, "error", err)
+        }
+    }
+    return deltaResult{
+        pos:      pos,
+        appliedX: pos.DX,
+        appliedY: pos.DY,
+        clamped:  xClamped || yClamped,
+    }
+}
+
+// previewDelta computes where moving car id by (dx, dy) would land, with
+// clamping, without writing to the store or broadcasting. Unlike applyDelta
+// it reads then adds, so the result may be stale by the time it is returned.
+func previewDelta(ctx context.Context, id string, dx, dy float64) (deltaResult, error) {
+    pos, err := readPosition(ctx, id)
+    if err != nil {
+        return deltaResult{}, err
+    }
+    if deltaTransform != nil {
+        if dx, dy, err = transformFrom(pos, dx, dy); err != nil {
+            return deltaResult{}, err
+        }
+    }
+    oldX, oldY := pos.X, pos.Y
+    newX, xClamped := clampPosition(oldX + dx)
+    newY, yClamped := clampPosition(oldY + dy)
+
+    if trackLength > 0 {
+        newX, xClamped = oldX+dx, false
+    }
+
+    preview := newPositionResponse(id, newX, newY)
+    preview.Heading = pos.Heading
+    preview.Seq = pos.Seq
+    preview.setDelta(newX-oldX, newY-oldY)
+    if pos.Lap != nil {
+        preview.placeOnTrack(float64(*pos.Lap))
+    }
+    return deltaResult{
+        pos:      preview,
+        appliedX: preview.DX,
+        appliedY: preview.DY,
+        clamped:  xClamped || yClamped,
+    }, nil
+}
+
+// storePosition overwrites some of car id's axes (or its heading) and bumps
+// the sequence number, in the same transaction as incrementState's, so no
+// reader sees the new values with the previous writer or seq.
+func storePosition(ctx context.Context, id string, values map[string]float64) (PositionResponse, error) {
+    // The audit trail records what the update replaced
+    var old []float64
+    if auditMax > 0 {
+        xKey, yKey := positionKeys(id)
+        var err error
+        if old, err = store.GetFloat(ctx, xKey, yKey); err != nil {
+            return PositionResponse{}, err
+        }
+    }
+    strs := writeInfo(ctx, id)
+    if strs == nil {
+        strs = make(map[string]string, len(values))
+    }
+    for key, v := range values {
+        strs[key] = formatNumber(v)
+    }
+    vals, err := incrNumbers(ctx, stateIncrements(id, nil), strs)
+    if err != nil {
+        return PositionResponse{}, err
+    }
+    pos := stateFromIncrements(id, vals)
+    if old != nil {
+        pos.oldX, pos.oldY = old[0], old[1]
+    }
+    return pos, nil
+}
+
+// incrementState adds deltas to some of car id's keys and bumps the sequence
+// number. The increment reads back both axes and the heading atomically with
+// the new seq, so the result reflects any update that raced with it.
+func incrementState(ctx context.Context, id string, deltas map[string]float64) (PositionResponse, error) {
+    vals, err := incrNumbers(ctx, stateIncrements(id, deltas), writeInfo(ctx, id))
+    if err != nil {
+        return PositionResponse{}, err
+    }
+    return stateFromIncrements(id, vals), nil
+}
+
+// stateIncrements is what incrementState adds to car id's keys: deltas,
+// seq's 1, and 0 to the rest of its state so the increment reads it back
+func stateIncrements(id string, deltas map[string]float64) map[string]float64 {
+    xKey, yKey := positionKeys(id)
+    incr := map[string]float64{xKey: 0, yKey: 0, headingKey(id): 0, key(seqKey): 1}
+    if trackLength > 0 {
+        incr[lapsKey(id)] = 0
+    }
+    for key, delta := range deltas {
+        incr[key] = delta
+    }
+    return incr
+}
+
+// stateFromIncrements builds car id's position from the results of
+// stateIncrements
+func stateFromIncrements(id string, vals map[string]float64) PositionResponse {
+    xKey, yKey := positionKeys(id)
+    pos := newPositionResponse(id, vals[xKey], vals[yKey])
+    pos.Heading = normalizeHeading(int64(vals[headingKey(id)]))
+    pos.Seq = int64(vals[key(seqKey)])
+    pos.placeOnTrack(vals[lapsKey(id)])
+    return pos
+}
+
+// formatNumber formats v as setNumbers stores it: whole unless in float mode
+func formatNumber(v float64) string {
+    if floatPositions {
+        return formatFloat(v)
+    }
+    return strconv.FormatInt(int64(v), 10)
+}
+
+// incrNumbers atomically adds deltas to the store, with INCRBYFLOAT in float
+// mode, and sets strs alongside. Integer mode only sees whole deltas and
+// uses INCRBY, so the stored values stay integers. Whole deltas such as
+// seq's keep the key whole in float mode too.
+func incrNumbers(ctx context.Context, deltas map[string]float64, strs map[string]string) (map[string]float64, error) {
+    if floatPositions {
+        return store.IncrByFloat(ctx, deltas, strs)
+    }
+    ints := make(map[string]int64, len(deltas))
+    for key, delta := range deltas {
+        ints[key] = int64(delta)
+    }
+    vals, err := store.IncrBy(ctx, ints, strs)
+    if err != nil {
+        return nil, err
+    }
+    result := make(map[string]float64, len(vals))
+    for key, v := range vals {
+        result[key] = float64(v)
+    }
+    return result, nil
+}
+
+// setNumbers overwrites keys in the store, as integers unless in float mode
+func setNumbers(ctx context.Context, values map[string]float64) error {
+    if floatPositions {
+        return store.SetFloat(ctx, values)
+    }
+    ints := make(map[string]int64, len(values))
+    for key, v := range values {
+        ints[key] = int64(v)
+    }
+    return store.Set(ctx, ints)
+}
+
+// queueSetNumbers is setNumbers queued on pipe
+func queueSetNumbers(ctx context.Context, pipe Pipeline, values map[string]float64) func() error {
+    if floatPositions {
+        return pipe.SetFloat(ctx, values)
+    }
+    ints := make(map[string]int64, len(values))
+    for key, v := range values {
+        ints[key] = int64(v)
+    }
+    return pipe.Set(ctx, ints)
+}
+
+// queueIncrNumbers is incrNumbers for a pipeline, without the results
+func queueIncrNumbers(ctx context.Context, pipe Pipeline, deltas map[string]float64) func() error {
+    if floatPositions {
+        return pipe.IncrByFloat(ctx, deltas)
+    }
+    ints := make(map[string]int64, len(deltas))
+    for key, delta := range deltas {
+        ints[key] = int64(delta)
+    }
+    return pipe.IncrBy(ctx, ints)
+}
+
+// representable reports whether v is valid input in the current
+// POSITION_MODE: any finite number in float mode, whole numbers otherwise
+func representable(v float64) bool {
+    if math.IsNaN(v) || math.IsInf(v, 0) {
+        return false
+    }
+    return floatPositions || v == math.Trunc(v)
+}
+
+// boundsError is the message for a position outside the configured bounds
+func boundsError() string {
+    cfg := currentConfig()
+    return fmt.Sprintf("position must be between %v and %v", cfg.MinPosition, cfg.MaxPosition)
+}
+
+// clampPosition limits a coordinate to [MinPosition, MaxPosition], reporting
+// whether it changed. Every mutation goes through it, so only in-bounds
+// positions are stored and broadcast.
+func clampPosition(v float64) (float64, bool) {
+    cfg := currentConfig()
+    if v < cfg.MinPosition {
+        return cfg.MinPosition, true
+    }
+    if v > cfg.MaxPosition {
+        return cfg.MaxPosition, true
+    }
+    return v, false
+}
+
+// healthHandler reports whether Redis is reachable, plus the WebSocket client count
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    // Use a per-request timeout so a hung Redis can't hold the probe open
+    pingCtx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+    defer cancel()
+
+    resp := HealthResponse{Status: "ok", Clients: clientCount()}
+    err := store.Ping(pingCtx)
+    recordStoreHealth(err)
+    if err != nil {
+        resp.Status = "degraded"
+        resp.Error = err.Error()
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+
+    _ = json.NewEncoder(w).Encode(resp)
+}
+
+// setPosition sets the position to an absolute value in Redis, then broadcasts
+func setPosition(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+
+    var req SetPositionRequest
+    if !decodeBody(w, r, &req) {
+        return
+    }
+    x := req.X
+    if req.Position != nil {
+        x = req.Position
+    }
+    if x == nil && req.Y == nil {
+        writeJSONError(w, http.StatusBadRequest, "position is required")
+        return
+    }
+    for _, v := range []*float64{x, req.Y} {
+        if v == nil {
+            continue
+        }
+        if errResp := absoluteError(*v); errResp != nil {
+            writeErrorResponse(w, *errResp)
+            return
+        }
+    }
+
+    xKey, yKey := positionKeys(id)
+    values := make(map[string]float64, 2)
+    if x != nil {
+        values[xKey] = *x
+    }
+    if req.Y != nil {
+        values[yKey] = *req.Y
+    }
+    // An absolute set is safe to retry, unlike a move
+    var pos PositionResponse
+    err := withReconnectRetry(ctx, func(ctx context.Context) (err error) {
+        pos, err = storePosition(ctx, id, values)
+        return err
+    })
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    publishPosition(ctx, pos)
+
+    _ = json.NewEncoder(w).Encode(pos)
+}
+
+// absoluteError checks a position to set exactly. Absolute sets are
+// rejected rather than clamped, since the caller asked for that position.
+func absoluteError(v float64) *ErrorResponse {
+    value := v
+    if !representable(v) {
+        return &ErrorResponse{Error: "position must be a whole number", Status: http.StatusBadRequest, Value: &value}
+    }
+    if _, clamped := clampPosition(v); clamped {
+        return &ErrorResponse{Error: boundsError(), Status: http.StatusBadRequest, Value: &value}
+    }
+    return nil
+}
+
+// batchPosition applies a queued list of X deltas as one update and one broadcast
+func batchPosition(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+
+    var req BatchRequest
+    if !decodeBody(w, r, &req) {
+        return
+    }
+    if len(req.Deltas) == 0 {
+        writeJSONError(w, http.StatusBadRequest, "deltas must not be empty")
+        return
+    }
+    if len(req.Deltas) > batchMax {
+        count := float64(len(req.Deltas))
+        writeErrorResponse(w, ErrorResponse{
+            Error:  fmt.Sprintf("at most %d deltas per batch", batchMax),
+            Status: http.StatusBadRequest,
+            Value:  &count,
+        })
+        return
+    }
+
+    maxDelta := currentConfig().MaxDelta
+    sum := 0.0
+    for _, d := range req.Deltas {
+        if !representable(d) {
+            value := d
+            writeErrorResponse(w, ErrorResponse{
+                Error:  "each delta must be a whole number",
+                Status: http.StatusBadRequest,
+                Value:  &value,
+            })
+            return
+        }
+        if d > float64(maxDelta) || d < -float64(maxDelta) {
+            value := d
+            writeErrorResponse(w, ErrorResponse{
+                Error:  fmt.Sprintf("each delta must be between %d and %d", -maxDelta, maxDelta),
+                Status: http.StatusBadRequest,
+                Value:  &value,
+            })
+            return
+        }
+        sum += d
+    }
+
+    // Moves that cancel out don't need a write or a broadcast
+    if sum == 0 {
+        pos, err := readPosition(ctx, id)
+        if err != nil {
+            writeJSONError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        _ = json.NewEncoder(w).Encode(BatchResponse{UpdateResponse: UpdateResponse{PositionResponse: pos}})
+        return
+    }
+
+    res, err := applyDelta(ctx, id, sum, 0)
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    _ = json.NewEncoder(w).Encode(BatchResponse{
+        UpdateResponse: UpdateResponse{PositionResponse: res.pos, Clamped: res.clamped},
+        Applied:        res.appliedX,
+    })
+}
+
+// getHistory returns the last `limit` position changes, oldest first
+func getHistory(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+
+    limit := int64(defaultHistoryLimit)
+    if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+        n, err := strconv.ParseInt(limitStr, 10, 64)
+        if err != nil || n <= 0 {
+            writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+            return
+        }
+        limit = n
+    }
+    if limit > historyMax {
+        limit = historyMax
+    }
+
+    var raw []string
+    err := withReconnectRetry(ctx, func(ctx context.Context) (err error) {
+        raw, err = store.ScoredTail(ctx, historyKey(id), limit)
+        return err
+    })
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    entries := make([]HistoryEntry, 0, len(raw))
+    for _, item := range raw {
+        var entry HistoryEntry
+        if err := json.Unmarshal([]byte(item), &entry); err != nil {
+            slog.WarnContext(ctx, "Skipping malformed history entry", "car_id", id, "error", err)
+            continue
+        }
+        entries = append(entries, entry)
+    }
+
+    _ = json.NewEncoder(w).Encode(entries)
+}
+
+// getPositionAt returns the latest history entry at or before ?ts=, in Unix
+// milliseconds like HistoryEntry.TS. Only the last historyMax changes are
+// kept, so older timestamps get 404.
+func getPositionAt(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+
+    ts, err := strconv.ParseInt(r.URL.Query().Get("ts"), 10, 64)
+    if err != nil || ts < 0 {
+        writeJSONError(w, http.StatusBadRequest, "ts must be a non-negative Unix timestamp in milliseconds")
+        return
+    }
+
+    var raw string
+    var found bool
+    err = withReconnectRetry(ctx, func(ctx context.Context) (err error) {
+        raw, found, err = store.ScoredAtOrBefore(ctx, historyKey(id), float64(ts))
+        return err
+    })
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    if !found {
+        writeJSONError(w, http.StatusNotFound, "no history at or before ts")
+        return
+    }
+
+    var entry HistoryEntry
+    if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+        writeJSONError(w, http.StatusInternalServerError, "malformed history entry: "+err.Error())
+        return
+    }
+    _ = json.NewEncoder(w).Encode(entry)
+}
+
+// resetPosition recenters the car at (0, 0), or the nearest in-bounds point, then broadcasts
+func resetPosition(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+
+    // A single atomic Set so concurrent increments see either the old or the
+    // reset state. Setting it again is harmless, so it may be retried.
+    var pos PositionResponse
+    err := withReconnectRetry(ctx, func(ctx context.Context) (err error) {
+        pos, err = storePosition(ctx, id, originValues(id))
+        return err
+    })
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    publishPosition(ctx, pos)
+
+    _ = json.NewEncoder(w).Encode(pos)
+}
+
+// originValues are the stored values putting car id back at the origin.
+// The origin may be out of bounds, so it is the closest in-bounds point.
+func originValues(id string) map[string]float64 {
+    origin, _ := clampPosition(0)
+    xKey, yKey := positionKeys(id)
+    values := map[string]float64{xKey: origin, yKey: origin}
+    if trackLength > 0 {
+        // Back to the start line on lap 0, whatever the bounds
+        values[xKey], values[lapsKey(id)] = 0, 0
+    }
+    return values
+}
+
+// getVersion reports which build is running
+func getVersion(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(VersionResponse{Version: Version, Commit: Commit, BuildTime: BuildTime})
+}
+
+// getClients returns how many WebSocket clients are connected to this instance
+func getClients(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(ClientsResponse{Count: clientCount()})
+}
+
+// getClientDetails lists every connected WebSocket client, oldest first
+func getClientDetails(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    wsMutex.Lock()
+    details := make([]ClientDetail, 0, len(wsClients))
+    for _, client := range wsClients {
+        details = append(details, ClientDetail{
+            ID:          client.id,
+            RemoteAddr:  client.remoteAddr,
+            ConnectedAt: client.connectedAt,
+            Protocol:    client.protocol,
+            Encoding:    client.encoding,
+            Format:      client.shape,
+            Role:        client.role,
+            Compressed:  client.compressed,
+        })
+    }
+    wsMutex.Unlock()
+
+    sort.Slice(details, func(i, j int) bool {
+        return details[i].ConnectedAt.Before(details[j].ConnectedAt)
+    })
+    _ = json.NewEncoder(w).Encode(details)
+}
+
+// disconnectClient closes the WebSocket client with the given ID, sending a
+// policy-violation close frame with ?reason= (or a default) and no
+// reconnect hint, and replying with the client's details. Unknown IDs get 404.
+func disconnectClient(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    reason := r.URL.Query().Get("reason")
+    if reason == "" {
+        reason = closeReasons[closePolicyViolation]
+    }
+    if _, ok := closeFrame(closePolicyViolation, reason, 0); !ok {
+        writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("reason must fit in %d bytes as JSON", maxCloseReasonLen))
+        return
+    }
+
+    id := mux.Vars(r)["id"]
+    wsMutex.Lock()
+    client, ok := wsClientsByID[id]
+    if !ok {
+        wsMutex.Unlock()
+        writeJSONError(w, http.StatusNotFound, "no such client")
+        return
+    }
+    // The writer sends the close frame, so a slow client can't stall others
+    shedClientReasonLocked(client, closePolicyViolation, reason, 0)
+    wsMutex.Unlock()
+
+    slog.InfoContext(r.Context(), "Disconnected WebSocket client", "client_id", id, "reason", reason)
+    _ = json.NewEncoder(w).Encode(ClientDetail{
+        ID:          client.id,
+        RemoteAddr:  client.remoteAddr,
+        ConnectedAt: client.connectedAt,
+        Protocol:    client.protocol,
+        Encoding:    client.encoding,
+        Format:      client.shape,
+        Role:        client.role,
+        Compressed:  client.compressed,
+    })
+}
+
+// wsHandler serves /ws for read-only viewers
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+    serveWS(w, r, roleViewer)
+}
+
+// wsControlHandler serves /ws/control, which requireControlToken guards
+func wsControlHandler(w http.ResponseWriter, r *http.Request) {
+    serveWS(w, r, roleControl)
+}
+
+// serveWS upgrades the connection to a WebSocket and adds it to our clients
+// with the given role
+func serveWS(w http.ResponseWriter, r *http.Request, role string) {
+    switch enc := r.URL.Query().Get("encoding"); enc {
+    case "", encodingJSON, encodingMsgpack:
+    default:
+        writeJSONError(w, http.StatusBadRequest, `encoding must be "json" or "msgpack"`)
+        return
+    }
+    if shape := r.URL.Query().Get("format"); shape != "" {
+        if _, ok := payloadShapes[shape]; !ok {
+            writeJSONError(w, http.StatusBadRequest, "unknown format: "+shape)
+            return
+        }
+    }
+    controller, ok := controllerFor(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid controller ID")
+        return
+    }
+
+    // Reserve a slot before upgrading, so concurrent connects can't all
+    // pass the check and overshoot the limit
+    ip := clientIP(r)
+    wsMutex.Lock()
+    if maxWSPerIP > 0 && wsPerIP[ip] >= maxWSPerIP {
+        wsMutex.Unlock()
+        slog.Warn("Rejecting WebSocket client, too many connections from its IP",
+            "remote_addr", remoteAddress(r), "max_per_ip", maxWSPerIP)
+        writeJSONError(w, http.StatusTooManyRequests, "too many WebSocket connections from this address")
+        return
+    }
+    if maxWSClients > 0 && len(wsClients)+wsPending >= maxWSClients {
+        wsMutex.Unlock()
+        slog.Warn("Rejecting WebSocket client, too many connections",
+            "remote_addr", remoteAddress(r), "max_clients", maxWSClients)
+        rejectFull(w, r)
+        return
+    }
+    wsPending++
+    wsPerIP[ip]++
+    wsMutex.Unlock()
+
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        wsMutex.Lock()
+        wsPending--
+        releaseIPLocked(ip)
+        wsMutex.Unlock()
+        // The upgrader has already replied with an HTTP error
+        slog.Debug("WebSocket upgrade failed", "remote_addr", r.RemoteAddr, "error", err)
+        return
+    }
+
+    // Only takes effect if the client negotiated permessage-deflate
+    compressed := compressionNegotiated(r)
+    if compressed {
+        _ = conn.SetCompressionLevel(wsCompressionLevel)
+    }
+
+    client := &wsClient{
+        id:          uuid.NewString(),
+        remoteAddr:  remoteAddress(r),
+        connectedAt: time.Now(),
+        ip:          ip,
+        role:        role,
+        controller:  controller,
+        conn:        conn,
+        syncLimit:   rate.NewLimiter(syncRate, syncBurst),
+        shard:       assignShard(),
+        send:        make(chan []byte, sendBufferSize),
+        compressed:  compressed,
+    }
+    format := negotiateFormat(r, conn)
+    client.protocol, client.encoding, client.shape = format.protocol, format.encoding, format.shape
+    // Before registering, so no broadcast can reach it without its form
+    if client.encoding == encodingMsgpack {
+        msgpackClients.Add(1)
+    }
+    noteShapeClient(client.shape, 1)
+
+    // A larger message fails the read loop, which closes with 1009
+    conn.SetReadLimit(wsMaxMessageBytes)
+
+    // The read loop errors out unless a pong arrives before the deadline
+    _ = conn.SetReadDeadline(time.Now().Add(pongWait))
+    conn.SetPongHandler(func(string) error {
+        return conn.SetReadDeadline(time.Now().Add(pongWait))
+    })
+
+    // Read the first snapshot before taking wsMutex; queueSnapshotLocked
+    // catches it up on anything fanned out meanwhile
+    snapshotCtx, cancel := requestContext(r)
+    state, haveState := readSnapshot(snapshotCtx, client)
+    cancel()
+
+    // Add this connection to our set of clients and queue the snapshot under
+    // the same lock, so no broadcast can be queued ahead of (and be older
+    // than) it
+    wsMutex.Lock()
+    wsPending--
+    wsClients[conn] = client
+    wsClientsByID[client.id] = client
+    count := len(wsClients)
+    wsClientsGauge.Set(float64(count))
+    wsCompressionGauge.WithLabelValues(compressionLabel(client.compressed)).Inc()
+    if client.protocol == "v2" {
+        if msg, ok := encodeMessage("hello", HelloMessage{Version: Version, ClientID: client.id}); ok {
+            enqueueLocked(client, msg)
+        }
+    }
+    if haveState {
+        queueSnapshotLocked(client, state)
+    }
+    if maintenanceMode.Load() {
+        if msg, ok := encodeMessage("maintenance", maintenanceMessage()); ok {
+            enqueueLocked(client, msg)
+        }
+    }
+    announcePresenceLocked("join", client)
+    wsMutex.Unlock()
+
+    slog.Info("WebSocket client connected",
+        "client_id", client.id, "remote_addr", client.remoteAddr, "role", client.role,
+        "protocol", client.protocol, "encoding", client.encoding, "format", client.shape,
+        "compression", client.compressed, "clients", count)
+
+    // Writer drains the client's queue; it is the only goroutine touching conn writes
+    wsWG.Add(1)
+    go handleWSWrite(client)
+
+    // Read loop; applies commands such as {"type": "move"}
+    go handleWSRead(client)
+}
+
+// negotiateFormat returns the message format for a new connection. The
+// protocol is the one named by the subprotocol the upgrader echoed,
+// WS_PROTOCOL if the client asked for none, or v1 if it only asked for ones
+// we don't speak. Frames are MessagePack if the subprotocol or
+// ?encoding=msgpack says so, JSON otherwise. Position messages take the
+// payload shape named by ?format=, or BROADCAST_FORMAT's.
+func negotiateFormat(r *http.Request, conn *websocket.Conn) wsFormat {
+    format, ok := subprotocolFormats[conn.Subprotocol()]
+    if !ok {
+        format = wsFormat{protocol: "v1", encoding: encodingJSON}
+        if len(websocket.Subprotocols(r)) == 0 {
+            format.protocol = wsProtocol
+        }
+    }
+    if r.URL.Query().Get("encoding") == encodingMsgpack {
+        format.encoding = encodingMsgpack
+    }
+    format.shape = broadcastShape
+    if shape := r.URL.Query().Get("format"); shape != "" {
+        format.shape = shape
+    }
+    return format
+}
+
+// compressionNegotiated reports whether upgrading r agrees on
+// permessage-deflate. gorilla/websocket doesn't expose the extensions it
+// accepted, so this repeats its rule: with compression enabled, it accepts
+// whenever the client's Sec-WebSocket-Extensions offers permessage-deflate.
+func compressionNegotiated(r *http.Request) bool {
+    if !upgrader.EnableCompression {
+        return false
+    }
+    for _, offers := range r.Header.Values("Sec-WebSocket-Extensions") {
+        for _, offer := range strings.Split(offers, ",") {
+            name, _, _ := strings.Cut(offer, ";")
+            if strings.TrimSpace(name) == "permessage-deflate" {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// compressionLabel is the websocket_compression_clients label for compressed
+func compressionLabel(compressed bool) string {
+    if compressed {
+        return "on"
+    }
+    return "off"
+}
+
+// rejectFull turns away a WebSocket client over MAX_WS_CLIENTS. Browsers
+// can't read an HTTP error on a failed upgrade, so it upgrades and closes
+// with a try-again-later frame telling the client when to come back.
+func rejectFull(w http.ResponseWriter, r *http.Request) {
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        // The upgrader has already replied with an HTTP error
+        return
+    }
+    closeClient(conn, closeTryAgainLater, fullReconnectAfter)
+    conn.Close()
+}
+
+// handleWSRead reads commands from the client until it closes or errors
+func handleWSRead(client *wsClient) {
+    // Runs however the connection ends, so abrupt disconnects are announced
+    // too. A panicking command only costs the client its connection.
+    defer func() {
+        if p := recover(); p != nil {
+            logPanic(context.Background(), "websocket", p, "client_id", client.id)
+        }
+        wsMutex.Lock()
+        unregisterClientLocked(client)
+        announcePresenceLocked("leave", client)
+        wsMutex.Unlock()
+    }()
+
+    for {
+        _, data, err := client.conn.ReadMessage()
+        if err != nil {
+            break
+        }
+        handleWSCommand(client, data)
+    }
+}
+
+// handleWSCommand applies a command sent by a client. Malformed or invalid
+// commands are logged and ignored; they never close the connection.
+func handleWSCommand(client *wsClient, data []byte) {
+    var cmd WSCommand
+    if err := json.Unmarshal(data, &cmd); err != nil {
+        slog.Warn("Ignoring malformed WebSocket message", "client_id", client.id, "error", err)
+        return
+    }
+
+    switch cmd.Type {
+    case "move":
+        // Same rules as POST /position, including auth and the per-IP rate limit
+        if client.role != roleControl {
+            slog.Warn("Ignoring move from read-only client", "client_id", client.id)
+            return
+        }
+        if !limiterFor(client.ip).Allow() {
+            slog.Warn("Ignoring rate-limited move", "client_id", client.id)
+            return
+        }
+        if maintenanceMode.Load() {
+            slog.Warn("Ignoring move in maintenance mode", "client_id", client.id)
+            return
+        }
+        if replaySteps != nil {
+            slog.Warn("Ignoring move in replay mode", "client_id", client.id)
+            return
+        }
+        dx := cmd.DX + cmd.Delta
+        if errResp := validateDelta(dx, cmd.DY); errResp != nil {
+            slog.Warn("Ignoring invalid move", "client_id", client.id, "error", errResp.Error)
+            return
+        }
+        // The upgrade request is long gone, so each move gets its own deadline
+        ctx := withSource(withWriter(context.Background(), client.controller), auditSourceWS)
+        ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+        defer cancel()
+        if _, err := moveCar(ctx, "", dx, cmd.DY); err != nil {
+            slog.Error("Error applying move", "client_id", client.id, "error", err)
+        }
+    case "sync":
+        // Resend the current position, e.g. after the tab regains focus
+        if !client.syncLimit.Allow() {
+            slog.Warn("Ignoring rate-limited sync", "client_id", client.id)
+            return
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+        defer cancel()
+        sendCurrentPosition(ctx, client)
+    case "ack":
+        client.acks.record(cmd.Seq)
+    case "subscribe":
+        subscribeClient(client, cmd.IDs)
+    default:
+        slog.Warn("Ignoring unknown WebSocket message type", "client_id", client.id, "type", cmd.Type)
+    }
+}
+
+// handleWSWrite writes queued messages and periodic pings to the connection
+// until the client's send channel is closed, then closes the connection.
+func handleWSWrite(client *wsClient) {
+    frameType := websocket.TextMessage
+    if client.encoding == encodingMsgpack {
+        frameType = websocket.BinaryMessage
+    }
+    ticker := time.NewTicker(pingInterval)
+    defer func() {
+        ticker.Stop()
+        client.conn.Close()
+        slog.Info("WebSocket client disconnected",
+            "client_id", client.id, "remote_addr", client.remoteAddr, "clients", clientCount())
+        wsWG.Done()
+    }()
+
+    for {
+        select {
+        case msg, ok := <-client.send:
+            if !ok {
+                if client.closeCode != 0 {
+                    reason := client.closeReason
+                    if reason == "" {
+                        reason = closeReasons[client.closeCode]
+                    }
+                    frame, _ := closeFrame(client.closeCode, reason, client.reconnectAfter)
+                    writeCloseFrame(client.conn, frame)
+                }
+                return
+            }
+            // A write that times out is handled like any other write error
+            _ = client.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+            if err := client.conn.WriteMessage(frameType, msg); err != nil {
+                slog.Warn("Error writing to WebSocket client", "client_id", client.id, "error", err)
+                broadcastErrorsTotal.Inc()
+                // Keep draining so we exit once the channel is closed
+                removeClient(client)
+            }
+        case <-ticker.C:
+            _ = client.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+            if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+                slog.Warn("Error pinging WebSocket client", "client_id", client.id, "error", err)
+                removeClient(client)
+            } else if !checkAcks(client) {
+                shedClient(client, closeTooSlow, slowReconnectAfter)
+            }
+        }
+    }
+}
+
+// clientCount returns the number of connected WebSocket clients
+func clientCount() int {
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+    return len(wsClients)
+}
+
+// removeClient unregisters the client, closing its send channel exactly once.
+// Safe to call from both the reader and writer goroutines.
+func removeClient(client *wsClient) {
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+    unregisterClientLocked(client)
+}
+
+// shedClient unregisters the client like removeClient, having its writer
+// goroutine send it a close frame with code on the way out
+func shedClient(client *wsClient, code int, reconnectAfter time.Duration) {
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+    shedClientLocked(client, code, reconnectAfter)
+}
+
+// shedClientLocked is shedClient for callers holding wsMutex. The writer
+// sends the frame so a slow client can't block us, or others, on it.
+func shedClientLocked(client *wsClient, code int, reconnectAfter time.Duration) {
+    shedClientReasonLocked(client, code, "", reconnectAfter)
+}
+
+// shedClientReasonLocked is shedClientLocked with a reason other than code's
+// usual one; "" keeps that one
+func shedClientReasonLocked(client *wsClient, code int, reason string, reconnectAfter time.Duration) {
+    if wsClients[client.conn] != client {
+        return
+    }
+    // Closing send below publishes these to the writer
+    client.closeCode, client.closeReason, client.reconnectAfter = code, reason, reconnectAfter
+    unregisterClientLocked(client)
+}
+
+// unregisterClientLocked removes the client from wsClients and closes its send
+// channel, which tells the writer goroutine to shut the connection down. Only
+// the first call for a client does anything, however many goroutines make
+// one. The writer alone closes the connection, after any close frame.
+// The caller must hold wsMutex.
+func unregisterClientLocked(client *wsClient) {
+    client.unregister.Do(func() {
+        // Only delete entries that are still ours: a later client whose conn
+        // reused this pointer must stay registered
+        if wsClients[client.conn] == client {
+            delete(wsClients, client.conn)
+        }
+        if wsClientsByID[client.id] == client {
+            delete(wsClientsByID, client.id)
+        }
+        releaseIPLocked(client.ip)
+        if client.encoding == encodingMsgpack {
+            msgpackClients.Add(-1)
+        }
+        noteShapeClient(client.shape, -1)
+        wsCompressionGauge.WithLabelValues(compressionLabel(client.compressed)).Dec()
+        client.sendMu.Lock()
+        client.closed = true
+        close(client.send)
+        client.sendMu.Unlock()
+        wsClientsGauge.Set(float64(len(wsClients)))
+    })
+}
+
+// releaseIPLocked gives back a connection slot of ip, reserved in serveWS.
+// The caller must hold wsMutex.
+func releaseIPLocked(ip string) {
+    if wsPerIP[ip]--; wsPerIP[ip] <= 0 {
+        delete(wsPerIP, ip)
+    }
+}
+
+// closeAllClients sheds every connected client, so its writer goroutine
+// sends it a going-away close frame and exits. Each gets its own reconnect
+// hint, so they spread out over the restart.
+func closeAllClients() {
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+
+    for _, client := range wsClients {
+        shedClientLocked(client, closeGoingAway, shutdownReconnectAfter)
+    }
+}
+
+// announcePresenceLocked tells every client except subject that it joined
+// or left. The caller must hold wsMutex.
+func announcePresenceLocked(event string, subject *wsClient) {
+    msg, ok := encodeMessage("presence", PresenceMessage{
+        Type:  "presence",
+        Event: event,
+        ID:    subject.id,
+        Count: len(wsClients),
+    })
+    if !ok {
+        return
+    }
+    for _, client := range wsClients {
+        if client != subject {
+            enqueueLocked(client, msg)
+        }
+    }
+}
+
+// enqueueLocked queues msg for the client, dropping it if its buffer is
+// full under the drop-client policy. The caller must hold wsMutex.
+func enqueueLocked(client *wsClient, msg wsMessage) {
+    if client.deliver(msg.forClient(client)) {
+        return
+    }
+    slog.Warn("WebSocket client send buffer full, dropping connection", "client_id", client.id)
+    broadcastErrorsTotal.Inc()
+    shedClientLocked(client, closeTooSlow, slowReconnectAfter)
+}
+
+// deliver does a non-blocking send of msg to the client's queue. If its
+// buffer is full, wsBackpressure decides whether the oldest queued message
+// is discarded or deliver reports false so the caller drops the client.
+// Sending to a client that is already gone, or a nil msg, is a no-op.
+func (c *wsClient) deliver(msg []byte) bool {
+    c.sendMu.Lock()
+    defer c.sendMu.Unlock()
+    if c.closed || msg == nil {
+        return true
+    }
+
+    select {
+    case c.send <- msg:
+        return true
+    default:
+    }
+
+    c.noteOverflowLocked()
+    if wsBackpressure == "drop-oldest" {
+        // Only deliver sends, and it holds sendMu, so once the head is
+        // gone there is room. The writer may take it first, which is fine.
+        select {
+        case <-c.send:
+            messagesDroppedTotal.Inc()
+        default:
+        }
+        c.send <- msg
+        return true
+    }
+    return false
+}
+
+// How often a client that keeps overflowing under drop-oldest is logged again
+const overflowLogEvery = 100
+
+// noteOverflowLocked counts a message that found c's send buffer full and
+// logs it, so overflows can be traced to the clients causing them. Under
+// drop-oldest a client stays connected, so only every overflowLogEvery-th
+// is logged after the first. The caller must hold c.sendMu.
+func (c *wsClient) noteOverflowLocked() {
+    c.overflows++
+    queueOverflowsTotal.Inc()
+    if c.overflows%overflowLogEvery != 1 {
+        return
+    }
+    slog.Warn("WebSocket client send buffer full",
+        "client_id", c.id, "remote_addr", c.remoteAddr, "queue_depth", sendBufferSize,
+        "overflows", c.overflows, "backpressure", wsBackpressure)
+}
+
+// queuedMessages is how many messages wait in all clients' send buffers
+func queuedMessages() int {
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+    n := 0
+    for _, client := range wsClients {
+        n += len(client.send)
+    }
+    return n
+}
+
+// wsMessage is an outbound WebSocket message in every format, so a
+// broadcast is encoded once however its clients are split between them
+type wsMessage struct {
+    v1        []byte // data bare
+    v2        []byte // {"type": msgType, "data": data}
+    v1Msgpack []byte // v1 and v2 as MessagePack; nil if no client needed them
+    v2Msgpack []byte
+
+    shaped map[string]wsMessage // The message in each other payload shape in use
+}
+
+// forClient returns the form matching the client's shape, protocol and
+// encoding
+func (m wsMessage) forClient(c *wsClient) []byte {
+    if shaped, ok := m.shaped[c.shape]; ok {
+        return shaped.forClient(c)
+    }
+    switch {
+    case c.encoding == encodingMsgpack && c.protocol == "v2":
+        return m.v2Msgpack
+    case c.encoding == encodingMsgpack:
+        return m.v1Msgpack
+    case c.protocol == "v2":
+        return m.v2
+    }
+    return m.v1
+}
+
+// encodeMessage marshals an outbound WebSocket message for both protocols,
+// and as MessagePack too while any client uses it. Position messages are
+// also reshaped for clients using other payload shapes.
+func encodeMessage(msgType string, data interface{}) (wsMessage, bool) {
+    msg, ok := encodeForms(msgType, data)
+    if ok && msgType == "position" {
+        msg.shaped = reshapeMessage(msgType, data)
+    }
+    return msg, ok
+}
+
+// encodeForms is encodeMessage in the standard shape only
+func encodeForms(msgType string, data interface{}) (wsMessage, bool) {
+    v1, ok := marshalMessage(context.Background(), msgType, data)
+    if !ok {
+        return wsMessage{}, false
+    }
+    v2, ok := marshalMessage(context.Background(), msgType, Envelope{Type: msgType, Data: json.RawMessage(v1)})
+    if !ok {
+        return wsMessage{}, false
+    }
+    msg := wsMessage{v1: v1, v2: v2}
+    if msgpackClients.Load() > 0 {
+        // A failure here only costs MessagePack clients this message
+        msg.v1Msgpack, _ = marshalMsgpack(msgType, data)
+        msg.v2Msgpack, _ = marshalMsgpack(msgType, Envelope{Type: msgType, Data: data})
+    }
+    return msg, true
+}
+
+// marshalMessage encodes an outbound message of the given type. A failure
+// is logged and counted, and ok is false so the caller skips sending
+// rather than sending garbage.
+func marshalMessage(ctx context.Context, msgType string, v interface{}) (msg []byte, ok bool) {
+    msg, err := json.Marshal(v)
+    if err != nil {
+        slog.ErrorContext(ctx, "Error encoding message, not sending it", "msg_type", msgType, "error", err)
+        marshalErrorsTotal.WithLabelValues(msgType).Inc()
+        return nil, false
+    }
+    return msg, true
+}
+
+// broadcastPosition sends the given `pos` to all connected WebSocket clients,
+// right away or at the end of the current debounce window. Once ctx is
+// cancelled the clients not yet sent to are skipped; a debounced window is
+// flushed under the ctx of the call that opened it.
+func broadcastPosition(ctx context.Context, pos PositionResponse) {
+    if broadcastDebounce == 0 {
+        fanOutPosition(ctx, pos)
+        return
+    }
+
+    pendingMutex.Lock()
+    defer pendingMutex.Unlock()
+
+    // Keep only the newest position of each car; updates from other
+    // instances may arrive out of order. The deltas add up, so clients
+    // still see the whole change made during the window.
+    if prev, ok := pendingPositions[pos.ID]; ok {
+        dx, dy := prev.DX+pos.DX, prev.DY+pos.DY
+        if pos.Seq < prev.Seq {
+            pos = prev
+        }
+        pos.setDelta(dx, dy)
+    }
+    pendingPositions[pos.ID] = pos
+    if !flushScheduled {
+        flushScheduled = true
+        time.AfterFunc(broadcastDebounce, func() { flushPendingPositions(ctx) })
+    }
+}
+
+// flushPendingPositions broadcasts the positions collected during a debounce window
+func flushPendingPositions(ctx context.Context) {
+    pendingMutex.Lock()
+    pending := pendingPositions
+    pendingPositions = make(map[string]PositionResponse)
+    flushScheduled = false
+    pendingMutex.Unlock()
+
+    for _, pos := range pending {
+        fanOutPosition(ctx, pos)
+    }
+}
+
+// fanOutPosition hands pos to the fan-out workers for every connected
+// WebSocket client and queues it for matching event streams, unless ctx is
+// already cancelled
+func fanOutPosition(ctx context.Context, pos PositionResponse) {
+    simulateLatency()
+    if ctx.Err() != nil {
+        return
+    }
+    observePosition(pos)
+    noteBroadcastSeq(pos.Seq)
+    broadcastCars.Store(pos.ID, struct{}{})
+    msg, ok := encodeMessage("position", pos)
+    if !ok {
+        return
+    }
+
+    broadcastsCount.Add(1)
+    dispatchCarFanOut(ctx, pos.ID, msg)
+
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+    noteFanOutLocked(pos)
+    enqueueStreamsLocked(pos)
+    notifyPollsLocked(pos)
+}
+
+// sendCurrentPosition fetches the current state from Redis and queues it for a single WebSocket client.
+func sendCurrentPosition(ctx context.Context, client *wsClient) {
+    state, ok := readSnapshot(ctx, client)
+    if !ok {
+        return
+    }
+
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+    // The client may have disconnected in the meantime
+    if wsClients[client.conn] == client {
+        queueSnapshotLocked(client, state)
+    }
+}
+
+// readSnapshot reads the current CarState for a snapshot to client, with ok
+// false (and the error logged) if it can't. Call it without wsMutex, then
+// queue the state with queueSnapshotLocked.
+func readSnapshot(ctx context.Context, client *wsClient) (state CarState, ok bool) {
+    state, err := readState(ctx, "")
+    if err != nil {
+        slog.Error("Error reading state", "client_id", client.id, "error", err)
+        return CarState{}, false
+    }
+    return state, true
+}
+
+// queueSnapshotLocked queues state, read by readSnapshot, for client. A
+// position fanned out since the read replaces the state's, so the snapshot
+// is never older than a broadcast queued after it. The caller must hold
+// wsMutex.
+func queueSnapshotLocked(client *wsClient, state CarState) {
+    if latest, ok := fannedOut[""]; ok && latest.Seq > state.Seq {
+        state.PositionResponse = latest
+    }
+    if msg, ok := encodeMessage("position", state); ok {
+        enqueueLocked(client, msg)
+    }
+}
+
+// -------------------- MIDDLEWARE -------------------- //
+
+// checkOrigin is the upgrader's CheckOrigin. Requests without an Origin
+// header don't come from a browser, so like the default upgrader we let
+// them through; the upgrader answers 403 for anything else not allowed.
+func checkOrigin(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    return origin == "" || currentConfig().originAllowed(origin)
+}
+
+// writeRoute wraps a handler that changes state: it requires the control
+// token, is rate limited per client IP, is refused in maintenance and replay
+// modes and records its controller as the car's last writer
+func writeRoute(h http.HandlerFunc) http.Handler {
+    return requireControlToken(rateLimitMiddleware(maintenanceMiddleware(replayMiddleware(writerMiddleware(h)))))
+}
+
+// requireControlToken rejects requests with 401 unless they carry
+// "Authorization: Bearer <CONTROL_TOKEN>". Without a configured token every
+// request is let through.
+func requireControlToken(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !hasControlToken(r) {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            writeJSONError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// hasControlToken reports whether r may control the car. Browsers can't set
+// headers on WebSocket upgrades, so a ?token= query parameter also counts.
+func hasControlToken(r *http.Request) bool {
+    if controlToken == "" {
+        return true
+    }
+    token := r.URL.Query().Get("token")
+    if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+        token = strings.TrimPrefix(auth, "Bearer ")
+    }
+    return subtle.ConstantTimeCompare([]byte(token), []byte(controlToken)) == 1
+}
+
+// rateLimitMiddleware rejects requests with 429 once the client IP exceeds
+// its token bucket. Apply it only to the routes that should be limited.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !limiterFor(clientIP(r)).Allow() {
+            writeJSONError(w, http.StatusTooManyRequests, "rate limit exceeded")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// limiterFor returns the limiter for ip, creating it on first use
+func limiterFor(ip string) *rate.Limiter {
+    limitersMutex.Lock()
+    defer limitersMutex.Unlock()
+
+    l, ok := limiters[ip]
+    if !ok {
+        cfg := currentConfig()
+        l = &ipLimiter{limiter: rate.NewLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)}
+        limiters[ip] = l
+    }
+    l.lastSeen = time.Now()
+    return l.limiter
+}
+
+// applyRateLimit resizes every existing limiter after a config reload;
+// limiterFor gives new ones the current settings
+func applyRateLimit(rps rate.Limit, burst int) {
+    limitersMutex.Lock()
+    defer limitersMutex.Unlock()
+    for _, l := range limiters {
+        l.limiter.SetLimit(rps)
+        l.limiter.SetBurst(burst)
+    }
+}
+
+// cleanupLimiters periodically forgets IPs that haven't been seen recently
+func cleanupLimiters() {
+    ticker := time.NewTicker(limiterCleanupInterval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        limitersMutex.Lock()
+        for ip, l := range limiters {
+            if time.Since(l.lastSeen) > limiterTTL {
+                delete(limiters, ip)
+            }
+        }
+        limitersMutex.Unlock()
+    }
+}
+
+// remoteAddress returns the address of the client behind r: with
+// TRUST_PROXY, the first X-Forwarded-For entry, otherwise r.RemoteAddr
+func remoteAddress(r *http.Request) string {
+    if trustProxy {
+        if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+            first, _, _ := strings.Cut(fwd, ",")
+            if first = strings.TrimSpace(first); first != "" {
+                return first
+            }
+        }
+    }
+    return r.RemoteAddr
+}
+
+// clientIP returns the host part of the request's remote address
+func clientIP(r *http.Request) string {
+    addr := remoteAddress(r)
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return addr
+    }
+    return host
+}
+
+// recoverMiddleware turns a panicking handler into a logged, counted 500
+// instead of a crashed server. Long-lived routes may have hijacked or
+// started streaming the response, so their connection is just dropped.
+func recoverMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        defer func() {
+            p := recover()
+            if p == nil {
+                return
+            }
+            if p == http.ErrAbortHandler {
+                // net/http's own way of aborting a response quietly
+                panic(p)
+            }
+            logPanic(r.Context(), "http", p, "method", r.Method, "path", r.URL.Path)
+            if !routeIn(r, longLivedRoutes) {
+                writeJSONError(w, http.StatusInternalServerError, "internal server error")
+            }
+        }()
+        next.ServeHTTP(w, r)
+    })
+}
+
+// logPanic logs a recovered panic with its stack trace and counts it
+func logPanic(ctx context.Context, source string, p interface{}, args ...interface{}) {
+    panicsRecoveredTotal.WithLabelValues(source).Inc()
+    args = append(args, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+    slog.ErrorContext(ctx, "Recovered from panic", args...)
+}
+
+// routeIn reports whether the path template of r's route is in routes
+func routeIn(r *http.Request, routes map[string]bool) bool {
+    route := mux.CurrentRoute(r)
+    if route == nil {
+        return false
+    }
+    tmpl, err := route.GetPathTemplate()
+    return err == nil && routes[tmpl]
+}
+
+// timeoutMiddleware answers 503 for any request whose handler runs longer
+// than handlerTimeout, cancelling its context. The response is buffered
+// until the handler returns, so streaming routes are left alone.
+func timeoutMiddleware(next http.Handler) http.Handler {
+    body, _ := json.Marshal(ErrorResponse{Error: "request timed out", Status: http.StatusServiceUnavailable})
+    timed := http.TimeoutHandler(next, handlerTimeout, string(body))
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if routeIn(r, longLivedRoutes) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        // Handlers set their own type; this one is for the timeout reply
+        w.Header().Set("Content-Type", "application/json")
+        timed.ServeHTTP(w, r)
+    })
+}
+
+// latencyMiddleware delays every request by the simulated latency. It is
+// only installed when SIMULATE_LATENCY_MS or SIMULATE_JITTER_MS is set.
+func latencyMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        simulateLatency()
+        next.ServeHTTP(w, r)
+    })
+}
+
+// simulateLatency sleeps for simulatedLatency plus a random jitter of up to
+// simulatedJitter. Without either set it returns immediately.
+func simulateLatency() {
+    delay := simulatedLatency
+    if simulatedJitter > 0 {
+        delay += time.Duration(rand.Int63n(int64(simulatedJitter) + 1))
+    }
+    if delay > 0 {
+        time.Sleep(delay)
+    }
+}
+
+// newRouter sets up the Gorilla Mux router with every route and its
+// middleware. It must run after the settings the routes depend on, such as
+// MOVEMENT_MODE and TEST_MODE, are read.
+func newRouter() *mux.Router {
+    r := mux.NewRouter()
+    r.Use(requestIDMiddleware)
+    r.Use(countRequestsMiddleware)
+    r.Use(accessLogMiddleware)
+    r.Use(recoverMiddleware)
+    r.Use(corsMiddleware)
+    r.Use(gzipMiddleware)
+    r.Use(timeoutMiddleware)
+    if simulatedLatency > 0 || simulatedJitter > 0 {
+        r.Use(latencyMiddleware)
+    }
+
+    // POST /position takes deltas, or velocities with MOVEMENT_MODE=velocity-time
+    postPosition := updatePosition
+    if movementMode == movementVelocityTime {
+        postPosition = updatePositionTimed
+    }
+
+    // Routes; writes go through writeRoute for auth and rate limiting.
+    // Preflights are handled for all of them below, so none lists OPTIONS.
+    r.HandleFunc("/position", getPosition).Methods("GET")
+    r.HandleFunc("/state", getState).Methods("GET")
+    r.Handle("/position", writeRoute(postPosition)).Methods("POST")
+    r.Handle("/position", writeRoute(setPosition)).Methods("PUT")
+    r.Handle("/position/reset", writeRoute(resetPosition)).Methods("POST")
+    r.Handle("/position/cas", writeRoute(casPosition)).Methods("POST")
+    r.Handle("/position/batch", writeRoute(batchPosition)).Methods("POST")
+    r.Handle("/position/goto", writeRoute(gotoWaypoint)).Methods("POST")
+    r.HandleFunc("/position/history", getHistory).Methods("GET")
+    r.HandleFunc("/position/at", getPositionAt).Methods("GET")
+    r.HandleFunc("/position/stream", streamPosition).Methods("GET")
+    r.HandleFunc("/position/poll", pollPosition).Methods("GET")
+    r.HandleFunc("/position/changes", getChanges).Methods("GET")
+    r.Handle("/velocity", writeRoute(setVelocity)).Methods("POST")
+    r.Handle("/heading", writeRoute(setHeading)).Methods("POST")
+
+    // Per-car routes; the handlers are shared with the single-car routes above
+    r.HandleFunc("/cars", getCars).Methods("GET")
+    r.HandleFunc("/cars/{id}/position", getPosition).Methods("GET")
+    r.HandleFunc("/cars/{id}/state", getState).Methods("GET")
+    r.Handle("/cars/{id}/position", writeRoute(postPosition)).Methods("POST")
+    r.Handle("/cars/{id}/position", writeRoute(setPosition)).Methods("PUT")
+    r.Handle("/cars/{id}/position/reset", writeRoute(resetPosition)).Methods("POST")
+    r.Handle("/cars/{id}/position/cas", writeRoute(casPosition)).Methods("POST")
+    r.Handle("/cars/{id}/position/batch", writeRoute(batchPosition)).Methods("POST")
+    r.Handle("/cars/{id}/position/goto", writeRoute(gotoWaypoint)).Methods("POST")
+    r.Handle("/cars/{id}/heading", writeRoute(setHeading)).Methods("POST")
+    r.HandleFunc("/cars/{id}/position/history", getHistory).Methods("GET")
+    r.HandleFunc("/cars/{id}/position/at", getPositionAt).Methods("GET")
+    r.HandleFunc("/cars/{id}/position/stream", streamPosition).Methods("GET")
+    r.HandleFunc("/cars/{id}/position/poll", pollPosition).Methods("GET")
+    r.HandleFunc("/cars/{id}/position/changes", getChanges).Methods("GET")
+
+    // Named positions for /position/goto
+    r.Handle("/waypoints/{name}", writeRoute(putWaypoint)).Methods("PUT")
+
+    // Prometheus metrics
+    r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+    // Liveness/readiness probe
+    r.HandleFunc("/healthz", healthHandler).Methods("GET")
+
+    // Build info of the running server
+    r.HandleFunc("/version", getVersion).Methods("GET")
+
+    // Uptime and totals, for deployments without Prometheus
+    r.HandleFunc("/stats", getStats).Methods("GET")
+
+    // Who changed what, for the operators
+    r.Handle("/audit", requireControlToken(http.HandlerFunc(getAudit))).Methods("GET")
+
+    // Number of connected viewers
+    r.HandleFunc("/clients", getClients).Methods("GET")
+    r.Handle("/clients/detail", requireControlToken(http.HandlerFunc(getClientDetails))).Methods("GET")
+    r.Handle("/clients/{id}/disconnect", requireControlToken(http.HandlerFunc(disconnectClient))).Methods("POST")
+
+    // Operator tools; notices still go out in maintenance mode, e.g. to announce it
+    r.Handle("/broadcast", requireControlToken(rateLimitMiddleware(http.HandlerFunc(postBroadcast)))).Methods("POST")
+    r.Handle("/admin/maintenance", requireControlToken(http.HandlerFunc(postMaintenance))).Methods("POST")
+    r.Handle("/admin/tick", requireControlToken(http.HandlerFunc(getTick))).Methods("GET")
+    r.Handle("/admin/tick", requireControlToken(http.HandlerFunc(putTick))).Methods("PUT")
+
+    // Never registered unless TEST_MODE=true
+    if testMode {
+        r.Handle("/test/seed", requireControlToken(http.HandlerFunc(seedState))).Methods("POST")
+    }
+
+    // WebSocket endpoint
+    r.HandleFunc("/ws", wsHandler)
+    r.Handle("/ws/control", requireControlToken(http.HandlerFunc(wsControlHandler)))
+
+    // CORS preflights for every route. corsMiddleware answers them, but mux
+    // only runs middleware for a matched route, so this one matches any
+    // OPTIONS request the routes above don't take.
+    r.Methods("OPTIONS").HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+    return r
+}
+
+func corsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        cfg := currentConfig()
+        origin := r.Header.Get("Origin")
+        switch {
+        case cfg.originAllowed("*") && !cfg.CORSAllowCredentials:
+            w.Header().Set("Access-Control-Allow-Origin", "*")
+        case origin != "" && cfg.originAllowed(origin):
+            w.Header().Set("Access-Control-Allow-Origin", origin)
+            if cfg.CORSAllowCredentials {
+                w.Header().Set("Access-Control-Allow-Credentials", "true")
+            }
+        }
+        w.Header().Add("Vary", "Origin")
+        w.Header().Set("Access-Control-Allow-Methods", strings.Join(cfg.CORSMethods, ", "))
+        w.Header().Set("Access-Control-Allow-Headers", strings.Join(cfg.CORSHeaders, ", "))
+        w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Idempotent-Replayed")
+        w.Header().Set("Access-Control-Max-Age", "3600")
+
+        if r.Method == http.MethodOptions {
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "sync/atomic"
+)
+
+// -------------------- MAINTENANCE -------------------- //
+
+// While set, e.g. during a migration, the car is frozen: every write route,
+// WebSocket move and velocity tick is refused, while reads and WebSocket
+// subscriptions keep working. Starts from MAINTENANCE_MODE.
+var maintenanceMode atomic.Bool
+
+// MaintenanceMessage is the JSON body for POST /admin/maintenance and the
+// message every WebSocket client receives when the mode changes, so it can
+// show a banner. The toggle travels on noticeChannel to every instance.
+type MaintenanceMessage struct {
+    Type    string `json:"type"`
+    Enabled *bool  `json:"enabled" validate:"required"`
+}
+
+// maintenanceMiddleware replies 503 to writes while maintenanceMode is set
+func maintenanceMiddleware(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if maintenanceMode.Load() {
+            writeJSONError(w, http.StatusServiceUnavailable, "maintenance mode: the car is read-only")
+            return
+        }
+        next(w, r)
+    }
+}
+
+// postMaintenance turns maintenance mode on or off on every instance and
+// replies with the new mode
+func postMaintenance(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    var req MaintenanceMessage
+    if !decodeBody(w, r, &req) || !validateBody(w, &req) {
+        return
+    }
+    req.Type = "maintenance"
+
+    // Apply it here right away; our own copy from the subscription is then a no-op
+    setMaintenance(ctx, *req.Enabled)
+    if payload, ok := marshalMessage(ctx, "maintenance", req); ok {
+        if err := store.Publish(ctx, key(noticeChannel), payload); err != nil {
+            slog.ErrorContext(ctx, "Error publishing maintenance mode; other instances keep theirs", "error", err)
+        }
+    }
+
+    _ = json.NewEncoder(w).Encode(req)
+}
+
+// setMaintenance switches maintenanceMode, telling our WebSocket clients if
+// it changed. Leaving maintenance also resends the position, so clients
+// resync after the migration.
+func setMaintenance(ctx context.Context, enabled bool) {
+    if !maintenanceMode.CompareAndSwap(!enabled, enabled) {
+        return
+    }
+    slog.InfoContext(ctx, "Maintenance mode changed", "enabled", enabled)
+
+    if msg, ok := encodeMessage("maintenance", maintenanceMessage()); ok {
+        dispatchFanOut(broadcastCtx, msg)
+    }
+    if enabled {
+        return
+    }
+    state, err := readState(ctx, "")
+    if err != nil {
+        slog.ErrorContext(ctx, "Error reading state to resync clients", "error", err)
+        return
+    }
+    if msg, ok := encodeMessage("position", state); ok {
+        dispatchCarFanOut(broadcastCtx, "", msg)
+    }
+}
+
+// maintenanceMessage describes the current mode for WebSocket clients
+func maintenanceMessage() MaintenanceMessage {
+    enabled := maintenanceMode.Load()
+    return MaintenanceMessage{Type: "maintenance", Enabled: &enabled}
+}
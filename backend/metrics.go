@@ -0,0 +1,138 @@
+package main
+
+import (
+    "context"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/redis/go-redis/v9"
+)
+
+// -------------------- METRICS -------------------- //
+
+var (
+    positionUpdatesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "car_position_updates_total",
+        Help: "Position changes handled by this instance.",
+    })
+    currentPosition = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Name: "car_position",
+        Help: "Latest broadcast position of each car, per axis.",
+    }, []string{"car", "axis"})
+    wsClientsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+        Name: "websocket_clients",
+        Help: "Currently connected WebSocket clients.",
+    })
+    wsCompressionGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Name: "websocket_compression_clients",
+        Help: "Connected WebSocket clients by whether permessage-deflate was negotiated (on or off).",
+    }, []string{"compression"})
+    broadcastErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "broadcast_errors_total",
+        Help: "WebSocket clients dropped because a write failed or their buffer was full.",
+    })
+    messagesDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "websocket_messages_dropped_total",
+        Help: "Queued WebSocket messages discarded under WS_BACKPRESSURE=drop-oldest.",
+    })
+    queueOverflowsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "websocket_queue_overflows_total",
+        Help: "Messages that found a WebSocket client's send buffer (BROADCAST_QUEUE_DEPTH) full, under either WS_BACKPRESSURE policy.",
+    })
+    sendQueueLength = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name: "websocket_send_queue_length",
+        Help: "Messages waiting in WebSocket clients' send buffers, summed over clients.",
+    }, func() float64 { return float64(queuedMessages()) })
+    fanOutQueueLength = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name: "broadcast_queue_length",
+        Help: "Broadcasts waiting for a fan-out worker, summed over workers.",
+    }, func() float64 { return float64(queuedBroadcasts()) })
+    ackLaggingTotal = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "websocket_ack_lagging_total",
+        Help: "Times an acking WebSocket client fell more than ACK_LAG_THRESHOLD positions behind.",
+    })
+    ackTimeoutsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "websocket_ack_timeouts_total",
+        Help: "Acking WebSocket clients disconnected for not acking within ACK_TIMEOUT.",
+    })
+    marshalErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "message_marshal_errors_total",
+        Help: "Outbound messages skipped because they could not be encoded, by message type.",
+    }, []string{"type"})
+    panicsRecoveredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "panics_recovered_total",
+        Help: "Panics caught instead of crashing the server, by where they happened (http or websocket).",
+    }, []string{"source"})
+    corruptValuesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "store_corrupt_values_total",
+        Help: "Store keys found holding something other than a number when read.",
+    })
+    redisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "redis_operation_duration_seconds",
+        Help:    "Latency of Redis commands and pipelines.",
+        Buckets: prometheus.ExponentialBuckets(0.0005, 2, 12),
+    }, []string{"op"})
+)
+
+// registerMetrics registers all collectors with the default registry
+func registerMetrics() {
+    prometheus.MustRegister(
+        positionUpdatesTotal,
+        currentPosition,
+        wsClientsGauge,
+        wsCompressionGauge,
+        broadcastErrorsTotal,
+        messagesDroppedTotal,
+        queueOverflowsTotal,
+        sendQueueLength,
+        fanOutQueueLength,
+        ackLaggingTotal,
+        ackTimeoutsTotal,
+        marshalErrorsTotal,
+        panicsRecoveredTotal,
+        corruptValuesTotal,
+        redisDuration,
+    )
+    // Both series exist from the start, so ratios work before any client connects
+    for _, label := range []string{"on", "off"} {
+        wsCompressionGauge.WithLabelValues(label)
+    }
+}
+
+// observePosition records pos as the latest position of its car
+func observePosition(pos PositionResponse) {
+    car := pos.ID
+    if car == "" {
+        car = "default"
+    }
+    currentPosition.WithLabelValues(car, "x").Set(pos.X)
+    currentPosition.WithLabelValues(car, "y").Set(pos.Y)
+}
+
+// redisMetricsHook times every Redis command and pipeline
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+    return next
+}
+
+func (redisMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+    return func(ctx context.Context, cmd redis.Cmder) error {
+        start := time.Now()
+        err := next(ctx, cmd)
+        redisDuration.WithLabelValues(cmd.Name()).Observe(time.Since(start).Seconds())
+        return err
+    }
+}
+
+func (redisMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+    return func(ctx context.Context, cmds []redis.Cmder) error {
+        start := time.Now()
+        err := next(ctx, cmds)
+        redisDuration.WithLabelValues("pipeline").Observe(time.Since(start).Seconds())
+        return err
+    }
+}
+
+// Compile-time check that the hook satisfies go-redis' interface
+var _ redis.Hook = redisMetricsHook{}
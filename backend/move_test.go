@@ -0,0 +1,131 @@
+package main
+
+import (
+    "context"
+    "io"
+    "log/slog"
+    "testing"
+    "time"
+)
+
+// benchRTT is the Redis round trip BenchmarkMove models
+const benchRTT = 2 * time.Millisecond
+
+// remoteStore is an InMemoryStore that takes rtt per round trip on the
+// calls a move makes, like a Redis that far away. Unless pipelined, each
+// write queued on its pipelines is a round trip of its own.
+type remoteStore struct {
+    *InMemoryStore
+    rtt       time.Duration
+    pipelined bool
+}
+
+func (s *remoteStore) IncrBy(ctx context.Context, deltas map[string]int64, strs map[string]string) (map[string]int64, error) {
+    time.Sleep(s.rtt)
+    return s.InMemoryStore.IncrBy(ctx, deltas, strs)
+}
+
+func (s *remoteStore) IncrByFloat(ctx context.Context, deltas map[string]float64, strs map[string]string) (map[string]float64, error) {
+    time.Sleep(s.rtt)
+    return s.InMemoryStore.IncrByFloat(ctx, deltas, strs)
+}
+
+func (s *remoteStore) Pipeline() Pipeline {
+    return &remotePipeline{Pipeline: s.InMemoryStore.Pipeline(), store: s}
+}
+
+// remotePipeline is a Pipeline of remoteStore
+type remotePipeline struct {
+    Pipeline
+    store *remoteStore
+}
+
+// send takes a round trip for one write, unless it waits for Exec
+func (p *remotePipeline) send(op func() error) func() error {
+    if !p.store.pipelined {
+        time.Sleep(p.store.rtt)
+    }
+    return op
+}
+
+func (p *remotePipeline) Set(ctx context.Context, values map[string]int64) func() error {
+    return p.send(p.Pipeline.Set(ctx, values))
+}
+
+func (p *remotePipeline) SetFloat(ctx context.Context, values map[string]float64) func() error {
+    return p.send(p.Pipeline.SetFloat(ctx, values))
+}
+
+func (p *remotePipeline) IncrBy(ctx context.Context, deltas map[string]int64) func() error {
+    return p.send(p.Pipeline.IncrBy(ctx, deltas))
+}
+
+func (p *remotePipeline) IncrByFloat(ctx context.Context, deltas map[string]float64) func() error {
+    return p.send(p.Pipeline.IncrByFloat(ctx, deltas))
+}
+
+func (p *remotePipeline) AddScored(ctx context.Context, key, value string, score float64, maxLen int64) func() error {
+    return p.send(p.Pipeline.AddScored(ctx, key, value, score, maxLen))
+}
+
+func (p *remotePipeline) AppendStream(ctx context.Context, key, value string, maxLen int64) func() error {
+    return p.send(p.Pipeline.AppendStream(ctx, key, value, maxLen))
+}
+
+func (p *remotePipeline) Publish(ctx context.Context, channel string, msg []byte) func() error {
+    return p.send(p.Pipeline.Publish(ctx, channel, msg))
+}
+
+func (p *remotePipeline) Exec(ctx context.Context) error {
+    if p.store.pipelined {
+        time.Sleep(p.store.rtt)
+    }
+    return p.Pipeline.Exec(ctx)
+}
+
+// BenchmarkMove measures applyDelta, the bulk of POST /position, against a
+// Redis benchRTT away, with the writes after the increment pipelined into
+// one round trip as they are, and sent one by one for comparison. The
+// clamped cases also correct both axes.
+func BenchmarkMove(b *testing.B) {
+    // Every move logs a line
+    prevLogger := slog.Default()
+    slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+    b.Cleanup(func() { slog.SetDefault(prevLogger) })
+
+    for _, bench := range []struct {
+        name      string
+        pipelined bool
+        clamped   bool
+    }{
+        {"pipelined", true, false},
+        {"sequential", false, false},
+        {"pipelined-clamped", true, true},
+        {"sequential-clamped", false, true},
+    } {
+        b.Run(bench.name, func(b *testing.B) {
+            prev := store
+            store = &remoteStore{InMemoryStore: NewInMemoryStore(), rtt: benchRTT, pipelined: bench.pipelined}
+            b.Cleanup(func() { store = prev })
+
+            // With no room, every move pushes both axes past MaxPosition
+            cfg := defaultConfig()
+            if bench.clamped {
+                cfg.MaxPosition = 0
+            }
+            setTestConfig(b, cfg)
+
+            ctx := context.Background()
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                res, err := applyDelta(ctx, "", 1, 1)
+                if err != nil {
+                    b.Fatal(err)
+                }
+                if res.clamped != bench.clamped {
+                    b.Fatalf("clamped = %v, want %v", res.clamped, bench.clamped)
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "os"
+    "time"
+)
+
+// -------------------- TIMED MOVEMENT -------------------- //
+
+// How POST /position is read, from MOVEMENT_MODE
+const (
+    movementDelta        = "delta"         // Deltas, applied as sent
+    movementVelocityTime = "velocity-time" // Velocities, applied for the time since the last move
+)
+
+var movementMode = movementDelta
+
+// Longest time a velocity is applied for, so the first move after a pause
+// doesn't make the car jump by everything it would have covered meanwhile
+const maxMoveInterval = time.Second
+
+// VelocityMoveRequest is the JSON body for POST /position with
+// MOVEMENT_MODE=velocity-time: units per second on each axis. The legacy
+// velocity moves X only, like delta.
+type VelocityMoveRequest struct {
+    Velocity float64 `json:"velocity"`
+    VX       float64 `json:"vx"`
+    VY       float64 `json:"vy"`
+}
+
+// validate caps each axis at MAX_DELTA per second, so no move can exceed
+// MAX_DELTA. Zero is fine: it only restarts the clock.
+func (req VelocityMoveRequest) validate() []FieldError {
+    var errs []FieldError
+    maxDelta := currentConfig().MaxDelta
+    for _, v := range []struct {
+        name  string
+        value float64
+    }{{"vx", req.VX + req.Velocity}, {"vy", req.VY}} {
+        value := v.value
+        if math.IsNaN(value) || math.IsInf(value, 0) || math.Abs(value) > float64(maxDelta) {
+            errs = append(errs, FieldError{
+                Field: v.name,
+                Error: fmt.Sprintf("%s must be between %d and %d", v.name, -maxDelta, maxDelta),
+                Value: &value,
+            })
+        }
+    }
+    return errs
+}
+
+// parseMovementMode reads MOVEMENT_MODE. It must run after POSITION_MODE
+// is read: scaled moves are rarely whole, so velocity-time needs floats.
+func parseMovementMode() {
+    switch mode := os.Getenv("MOVEMENT_MODE"); mode {
+    case "", movementDelta:
+    case movementVelocityTime:
+        if !floatPositions {
+            fatal("MOVEMENT_MODE=velocity-time requires POSITION_MODE=float")
+        }
+        movementMode = mode
+    default:
+        fatal("Invalid MOVEMENT_MODE value", "value", mode)
+    }
+}
+
+// movedAtKey returns the Redis key holding when car id last got a velocity
+// move, in Unix milliseconds
+func movedAtKey(id string) string {
+    if id == "" {
+        return key("carPosition:movedAt")
+    }
+    return key("carPosition:" + id + ":movedAt")
+}
+
+// updatePositionTimed is POST /position with MOVEMENT_MODE=velocity-time: it
+// moves the car by the sent velocity times the time since the car's last
+// move, however often clients send them, then broadcasts
+func updatePositionTimed(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+
+    var req VelocityMoveRequest
+    if !decodeBody(w, r, &req) || !validateBody(w, &req) {
+        return
+    }
+
+    // Velocities go through deltaTransform like deltas do, as units per
+    // second, before they are scaled
+    vx, vy, err := transformDelta(ctx, id, req.VX+req.Velocity, req.VY)
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    // Stamping the clock and moving the car are one step, so concurrent
+    // movers each cover a separate slice of time, exactly once. Not retried:
+    // the interval has been claimed, so a retry would move the car by a
+    // fresh, much shorter one.
+    xKey, yKey := positionKeys(id)
+    dt, vals, err := store.IncrByFloatSince(ctx, movedAtKey(id), time.Now(), maxMoveInterval,
+        map[string]float64{xKey: vx, yKey: vy}, stateIncrements(id, nil), writeInfo(ctx, id))
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    // Nothing moved, e.g. the first move or a stop; the clock is restarted
+    if vals == nil {
+        pos, err := readPosition(ctx, id)
+        if err != nil {
+            writeJSONError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        _ = json.NewEncoder(w).Encode(UpdateResponse{PositionResponse: pos})
+        return
+    }
+
+    res := settleDelta(ctx, id, vx*dt.Seconds(), vy*dt.Seconds(), vals)
+    _ = json.NewEncoder(w).Encode(UpdateResponse{
+        PositionResponse: res.pos,
+        Clamped:          res.clamped,
+    })
+}
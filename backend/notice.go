@@ -0,0 +1,100 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+)
+
+// -------------------- NOTICES -------------------- //
+
+// noticeChannel carries operator notices and maintenance mode changes to
+// all backend instances
+const noticeChannel = "notices"
+
+var noticeSub Subscription // Subscription to noticeChannel
+
+// NoticeMessage is the JSON body for POST /broadcast and the message every
+// WebSocket client receives, e.g. a maintenance banner. Clients should
+// ignore message types they don't know. Message is capped at 280 bytes.
+type NoticeMessage struct {
+    Type    string `json:"type"`
+    Message string `json:"message" validate:"required,max=280"`
+}
+
+func (n *NoticeMessage) validate() []FieldError {
+    if n.Type != "notice" {
+        return []FieldError{{Field: "type", Error: `type must be "notice"`}}
+    }
+    return nil
+}
+
+// postBroadcast sends a notice to every WebSocket client on every instance
+// and replies with how many are connected to this one
+func postBroadcast(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    var req NoticeMessage
+    if !decodeBody(w, r, &req) || !validateBody(w, &req) {
+        return
+    }
+
+    payload, ok := marshalMessage(ctx, "notice", req)
+    if !ok {
+        writeJSONError(w, http.StatusInternalServerError, "could not encode notice")
+        return
+    }
+    if err := store.Publish(ctx, key(noticeChannel), payload); err != nil {
+        // Our own clients should still see it
+        slog.ErrorContext(ctx, "Error publishing notice", "error", err)
+        fanOutNotice(req)
+    }
+    slog.InfoContext(ctx, "Broadcast notice", "message", req.Message)
+
+    _ = json.NewEncoder(w).Encode(ClientsResponse{Count: clientCount()})
+}
+
+// startNoticeSubscriber delivers notices published by any instance to our
+// WebSocket clients and applies maintenance mode changes. Messages sent
+// while the subscription is down are lost.
+func startNoticeSubscriber() error {
+    var err error
+    noticeSub, err = store.Subscribe(context.Background(), key(noticeChannel))
+    if err != nil {
+        return err
+    }
+
+    go func() {
+        for payload := range noticeSub.Messages() {
+            var notice NoticeMessage
+            if err := json.Unmarshal(payload, &notice); err != nil {
+                slog.Error("Error decoding notice", "error", err)
+                continue
+            }
+            if notice.Type != "maintenance" {
+                fanOutNotice(notice)
+                continue
+            }
+            var maint MaintenanceMessage
+            if err := json.Unmarshal(payload, &maint); err != nil || maint.Enabled == nil {
+                slog.Error("Error decoding maintenance mode change", "error", err)
+                continue
+            }
+            ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+            setMaintenance(ctx, *maint.Enabled)
+            cancel()
+        }
+    }()
+    return nil
+}
+
+// fanOutNotice hands notice to the fan-out workers for every connected client
+func fanOutNotice(notice NoticeMessage) {
+    if msg, ok := encodeMessage("notice", notice); ok {
+        dispatchFanOut(broadcastCtx, msg)
+    }
+}
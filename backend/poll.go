@@ -0,0 +1,125 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// -------------------- LONG POLLING -------------------- //
+
+// Longest GET /position/poll waits for a change before replying 304, from
+// POLL_TIMEOUT. It must be shorter than handlerTimeout.
+var pollTimeout = 10 * time.Second
+
+// pollWaiter is one GET /position/poll request waiting for a car to change
+type pollWaiter struct {
+    carID string
+    since int64
+    ready chan PositionResponse // Gets the first newer position; closed on shutdown
+}
+
+// Waiting polls; protected by wsMutex like sseClients, so a poll can't miss
+// a change made between its check and its registration
+var pollWaiters = make(map[*pollWaiter]struct{})
+
+// pollPosition replies with the car's position once its seq is above
+// ?since=, waiting up to pollTimeout for a change and replying 304 if none
+// comes. It is for clients behind proxies that block WebSockets and SSE.
+func pollPosition(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    // Proxies must not answer a later poll with this one's reply
+    w.Header().Set("Cache-Control", "no-store")
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+    var since int64
+    if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+        var err error
+        if since, err = strconv.ParseInt(sinceStr, 10, 64); err != nil {
+            writeJSONError(w, http.StatusBadRequest, "since must be a whole number")
+            return
+        }
+    }
+
+    // The seq read here is the newest of any car, so a client polling a
+    // quiet car may get one early reply before it starts waiting
+    ctx, cancel := requestContext(r)
+    pos, err := readPosition(ctx, id)
+    cancel()
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    if pos.Seq > since {
+        _ = json.NewEncoder(w).Encode(pos)
+        return
+    }
+
+    // Register under wsMutex, re-checking for a change fanned out since the
+    // read, like streamPosition, so none is missed
+    waiter := &pollWaiter{carID: id, since: since, ready: make(chan PositionResponse, 1)}
+    wsMutex.Lock()
+    latest, changed := fannedOut[id]
+    changed = changed && latest.Seq > since
+    if !changed {
+        pollWaiters[waiter] = struct{}{}
+    }
+    wsMutex.Unlock()
+    if changed {
+        _ = json.NewEncoder(w).Encode(latest)
+        return
+    }
+    defer removePoll(waiter)
+
+    timer := time.NewTimer(pollTimeout)
+    defer timer.Stop()
+
+    select {
+    case <-r.Context().Done():
+        // The client hung up; removePoll unregisters it
+    case <-timer.C:
+        w.WriteHeader(http.StatusNotModified)
+    case pos, ok := <-waiter.ready:
+        if !ok {
+            writeJSONError(w, http.StatusServiceUnavailable, "server shutting down")
+            return
+        }
+        _ = json.NewEncoder(w).Encode(pos)
+    }
+}
+
+// notifyPollsLocked hands pos to every poll waiting on its car for a seq
+// below pos's, and unregisters them. The caller must hold wsMutex.
+func notifyPollsLocked(pos PositionResponse) {
+    for waiter := range pollWaiters {
+        if waiter.carID != pos.ID || pos.Seq <= waiter.since {
+            continue
+        }
+        // ready has room: each waiter is sent to at most once
+        waiter.ready <- pos
+        delete(pollWaiters, waiter)
+    }
+}
+
+// removePoll unregisters waiter if it is still waiting
+func removePoll(waiter *pollWaiter) {
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+    delete(pollWaiters, waiter)
+}
+
+// closeAllPolls answers every waiting poll with 503, so server.Shutdown
+// doesn't wait out their timeouts
+func closeAllPolls() {
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+    for waiter := range pollWaiters {
+        close(waiter.ready)
+        delete(pollWaiters, waiter)
+    }
+}
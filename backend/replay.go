@@ -0,0 +1,152 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "os"
+    "strconv"
+    "time"
+)
+
+// -------------------- REPLAY -------------------- //
+
+// Writer recorded for moves made by the replay
+const replayWriter = "replay"
+
+// ReplayStep is one recorded move in REPLAY_FILE: a delta, as in POST
+// /position, applied afterMs milliseconds after the previous step (or the
+// start of the run)
+type ReplayStep struct {
+    Delta   float64 `json:"delta"`
+    DX      float64 `json:"dx"`
+    DY      float64 `json:"dy"`
+    AfterMs int64   `json:"afterMs"`
+}
+
+// Steps replayed from REPLAY_FILE, nil when not replaying. While replaying,
+// live input is ignored: write routes get 409, WebSocket moves are dropped
+// and velocity is not applied, so every run is identical.
+var replaySteps []ReplayStep
+
+// Whether the replay starts over when it ends, from REPLAY_LOOP; otherwise
+// the car idles at its last position
+var replayLoop bool
+
+// loadReplay reads REPLAY_FILE and REPLAY_LOOP. It must run after the
+// config is loaded, since steps are checked against MAX_DELTA.
+func loadReplay() {
+    path := os.Getenv("REPLAY_FILE")
+    if path == "" {
+        return
+    }
+    if loopStr := os.Getenv("REPLAY_LOOP"); loopStr != "" {
+        var err error
+        if replayLoop, err = strconv.ParseBool(loopStr); err != nil {
+            fatal("Invalid REPLAY_LOOP value", "value", loopStr)
+        }
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        fatal("Could not read REPLAY_FILE", "path", path, "error", err)
+    }
+    var steps []ReplayStep
+    if err := json.Unmarshal(data, &steps); err != nil {
+        fatal("Invalid REPLAY_FILE", "path", path, "error", err)
+    }
+    if len(steps) == 0 {
+        fatal("REPLAY_FILE has no steps", "path", path)
+    }
+    var total int64
+    for i, step := range steps {
+        if step.AfterMs < 0 {
+            fatal("Invalid REPLAY_FILE step: afterMs must not be negative", "path", path, "step", i)
+        }
+        if errResp := validateDelta(step.DX+step.Delta, step.DY); errResp != nil {
+            fatal("Invalid REPLAY_FILE step", "path", path, "step", i, "error", errResp.Error)
+        }
+        total += step.AfterMs
+    }
+    // A loop that takes no time would spin
+    if replayLoop && total == 0 {
+        fatal("A looping REPLAY_FILE must have some afterMs", "path", path)
+    }
+
+    replaySteps = steps
+    slog.Warn("Replaying REPLAY_FILE; live input is ignored",
+        "path", path, "steps", len(steps), "loop", replayLoop)
+}
+
+// replayMiddleware replies 409 to writes while replaying
+func replayMiddleware(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if replaySteps != nil {
+            writeJSONError(w, http.StatusConflict, "replay mode: live input is ignored")
+            return
+        }
+        next(w, r)
+    }
+}
+
+// runReplay plays replaySteps on the original car until ctx is cancelled,
+// once or, with REPLAY_LOOP, over and over. Each run starts from the
+// origin, whatever the store held before.
+func runReplay(ctx context.Context) {
+    defer tasksWG.Done()
+
+    for run := 1; ; run++ {
+        slog.Info("Replay started", "run", run)
+        if !replayRun(ctx) {
+            return
+        }
+        if !replayLoop {
+            slog.Info("Replay finished; the car idles")
+            return
+        }
+    }
+}
+
+// replayRun resets the car and applies every step on schedule, returning
+// false if ctx is cancelled first
+func replayRun(ctx context.Context) bool {
+    values := originValues("")
+    values[headingKey("")] = 0
+    pos, err := storePosition(ctx, "", values)
+    if err != nil {
+        slog.Error("Error resetting the car for replay", "error", err)
+    } else {
+        publishPosition(ctx, pos)
+    }
+
+    // Steps are due relative to the start, so slow moves don't add drift
+    due := time.Now()
+    for i, step := range replaySteps {
+        due = due.Add(time.Duration(step.AfterMs) * time.Millisecond)
+        if !sleepUntil(ctx, due) {
+            return false
+        }
+
+        // The car is frozen in maintenance mode, replay and all
+        if maintenanceMode.Load() {
+            continue
+        }
+        if _, err := applyDelta(withWriter(ctx, replayWriter), "", step.DX+step.Delta, step.DY); err != nil {
+            slog.Error("Error applying replay step", "step", i, "error", err)
+        }
+    }
+    return true
+}
+
+// sleepUntil waits until t, returning false if ctx is cancelled first
+func sleepUntil(ctx context.Context, t time.Time) bool {
+    timer := time.NewTimer(time.Until(t))
+    defer timer.Stop()
+    select {
+    case <-ctx.Done():
+        return false
+    case <-timer.C:
+        return true
+    }
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "net/http"
+
+    "github.com/google/uuid"
+)
+
+// -------------------- REQUEST IDS -------------------- //
+
+// requestIDHeader carries the request ID in both directions
+const requestIDHeader = "X-Request-ID"
+
+// Longest client-supplied request ID we accept; longer ones are replaced
+const maxRequestIDLen = 128
+
+// requestIDKey is the context key holding the request ID
+type requestIDKey struct{}
+
+// requestIDMiddleware reuses the caller's X-Request-ID or generates one,
+// echoes it in the response and attaches it to the request context
+func requestIDMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get(requestIDHeader)
+        if id == "" || len(id) > maxRequestIDLen {
+            id = uuid.NewString()
+        }
+        w.Header().Set(requestIDHeader, id)
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+    })
+}
+
+// requestIDFrom returns the request ID stored in ctx, or ""
+func requestIDFrom(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey{}).(string)
+    return id
+}
+
+// contextHandler adds the request ID from the context to every record, so
+// the *Context logging calls made while handling a request are tagged with it
+type contextHandler struct {
+    slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+    if id := requestIDFrom(ctx); id != "" {
+        record.AddAttrs(slog.String("request_id", id))
+    }
+    return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+    return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "math/rand"
+    "time"
+)
+
+// -------------------- STORE RETRIES -------------------- //
+
+// How many times handlers try a store call that fails with a connection
+// error, first try included, from STORE_RETRY_ATTEMPTS (1 disables retries):
+var storeRetryAttempts = 3
+
+// Wait before the first retry, from STORE_RETRY_DELAY; it doubles for each
+// further one, up to maxRetryDelay
+var storeRetryDelay = 50 * time.Millisecond
+
+const maxRetryDelay = time.Second
+
+// withRetry runs op up to attempts times, backing off between tries, while
+// it fails with a connection error such as a timeout or EOF. Any other
+// error, like a value that doesn't parse, is returned at once, as is the
+// last error when ctx is done. Retries get a fresh context, since a timeout
+// may have used up ctx's deadline on the client's side only.
+func withRetry(ctx context.Context, attempts int, op func(context.Context) error) error {
+    err := op(ctx)
+    retried := false
+    for attempt := 1; attempt < attempts && err != nil && isConnError(err); attempt++ {
+        if ctx.Err() != nil {
+            // The caller gave up; retrying won't help
+            return err
+        }
+        recordStoreHealth(err)
+        delay := retryDelay(attempt)
+        slog.WarnContext(ctx, "Store connection error, retrying",
+            "attempt", attempt, "delay", delay.String(), "error", err)
+        if !sleepUntil(ctx, time.Now().Add(delay)) {
+            return err
+        }
+
+        retryCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), healthCheckTimeout)
+        err = op(retryCtx)
+        cancel()
+        retried = true
+    }
+    if err == nil && retried {
+        recordStoreHealth(nil)
+    }
+    return err
+}
+
+// retryDelay is the wait before retry n (from 1): storeRetryDelay doubling
+// each time, capped at maxRetryDelay, with jitter so that handlers failing
+// together don't retry in lockstep
+func retryDelay(attempt int) time.Duration {
+    d := maxRetryDelay
+    if attempt < 20 {
+        d = min(storeRetryDelay<<(attempt-1), maxRetryDelay)
+    }
+    return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
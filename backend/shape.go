@@ -0,0 +1,102 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "log/slog"
+    "sync/atomic"
+)
+
+// -------------------- PAYLOAD SHAPES -------------------- //
+
+// Shape of position messages with the field names as documented
+const shapeStandard = "standard"
+
+// Field renames of position messages, by shape name, for frontends built
+// against other names. Fields not listed keep theirs, and other message
+// types are never reshaped.
+var payloadShapes = map[string]map[string]string{
+    shapeStandard: nil,
+    "short":       {"position": "pos"},
+    "minimal":     {"position": "p", "heading": "h", "seq": "s", "delta": "d"},
+}
+
+// Shape for WebSocket clients that don't pass ?format=, from BROADCAST_FORMAT:
+var broadcastShape = shapeStandard
+
+// Connected clients per shape other than shapeStandard. Position messages
+// are only reshaped for the shapes in use.
+var shapeClients = func() map[string]*atomic.Int64 {
+    counts := make(map[string]*atomic.Int64, len(payloadShapes))
+    for name := range payloadShapes {
+        if name != shapeStandard {
+            counts[name] = new(atomic.Int64)
+        }
+    }
+    return counts
+}()
+
+// noteShapeClient counts a client of shape joining (delta 1) or leaving
+// (delta -1)
+func noteShapeClient(shape string, delta int64) {
+    if count, ok := shapeClients[shape]; ok {
+        count.Add(delta)
+    }
+}
+
+// reshapeMessage encodes the position message data in every shape some
+// client uses, keyed by shape, or returns nil if all use shapeStandard
+func reshapeMessage(msgType string, data interface{}) map[string]wsMessage {
+    var shaped map[string]wsMessage
+    for name, count := range shapeClients {
+        if count.Load() == 0 {
+            continue
+        }
+        fields, ok := renameFields(msgType, data, payloadShapes[name])
+        if !ok {
+            continue
+        }
+        msg, ok := encodeForms(msgType, fields)
+        if !ok {
+            continue
+        }
+        if shaped == nil {
+            shaped = make(map[string]wsMessage)
+        }
+        shaped[name] = msg
+    }
+    return shaped
+}
+
+// renameFields returns data's JSON fields, renamed per renames. Whole
+// numbers stay integers, so MessagePack still sends them as ints.
+func renameFields(msgType string, data interface{}, renames map[string]string) (map[string]interface{}, bool) {
+    raw, ok := marshalMessage(context.Background(), msgType, data)
+    if !ok {
+        return nil, false
+    }
+    dec := json.NewDecoder(bytes.NewReader(raw))
+    dec.UseNumber()
+    var fields map[string]interface{}
+    if err := dec.Decode(&fields); err != nil {
+        slog.Error("Error reshaping message, not sending it reshaped", "msg_type", msgType, "error", err)
+        return nil, false
+    }
+
+    renamed := make(map[string]interface{}, len(fields))
+    for name, v := range fields {
+        if n, isNumber := v.(json.Number); isNumber {
+            if i, err := n.Int64(); err == nil {
+                v = i
+            } else {
+                v, _ = n.Float64()
+            }
+        }
+        if to, ok := renames[name]; ok {
+            name = to
+        }
+        renamed[name] = v
+    }
+    return renamed, true
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "io/fs"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// -------------------- SNAPSHOTS -------------------- //
+
+// File the full car state is saved to, from SNAPSHOT_FILE; "" disables
+// snapshots
+var snapshotFile string
+
+// How often the snapshot is rewritten, from SNAPSHOT_INTERVAL:
+var snapshotInterval = 30 * time.Second
+
+// Snapshot is the content of SNAPSHOT_FILE: the state of every car this
+// instance knew of when it was taken
+type Snapshot struct {
+    TakenAt time.Time  `json:"takenAt"`
+    Cars    []CarState `json:"cars"`
+}
+
+// restoreSnapshot reads SNAPSHOT_FILE and SNAPSHOT_INTERVAL and, if the
+// store is empty, loads the cars saved in the file into it, so state
+// survives losing Redis (or restarting with the memory store). A store
+// that already has a seq is left alone.
+func restoreSnapshot() {
+    snapshotFile = os.Getenv("SNAPSHOT_FILE")
+    snapshotInterval = durationFromEnv("SNAPSHOT_INTERVAL", snapshotInterval)
+    if snapshotFile == "" {
+        return
+    }
+
+    data, err := os.ReadFile(snapshotFile)
+    if errors.Is(err, fs.ErrNotExist) {
+        slog.Info("No snapshot to restore yet", "path", snapshotFile)
+        return
+    }
+    if err != nil {
+        fatal("Could not read SNAPSHOT_FILE", "path", snapshotFile, "error", err)
+    }
+    var snap Snapshot
+    if err := json.Unmarshal(data, &snap); err != nil {
+        fatal("Invalid SNAPSHOT_FILE", "path", snapshotFile, "error", err)
+    }
+    for _, car := range snap.Cars {
+        if car.ID != "" && !carIDPattern.MatchString(car.ID) {
+            fatal("Invalid car id in SNAPSHOT_FILE", "path", snapshotFile, "car_id", car.ID)
+        }
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+    defer cancel()
+
+    _, found, err := store.GetString(ctx, key(seqKey))
+    if err != nil {
+        fatal("Could not check the store before restoring the snapshot", "error", err)
+    }
+    if found {
+        slog.Info("Keeping existing state; the snapshot only applies to an empty store",
+            "path", snapshotFile, "taken_at", snap.TakenAt)
+        return
+    }
+
+    values := make(map[string]float64)
+    writers := make(map[string]string)
+    var seq int64
+    for _, car := range snap.Cars {
+        xKey, yKey := positionKeys(car.ID)
+        values[xKey], values[yKey] = car.X, car.Y
+        values[headingKey(car.ID)] = float64(car.Heading)
+        if car.Lap != nil {
+            values[lapsKey(car.ID)] = float64(*car.Lap)
+        }
+        if car.ID == "" {
+            values[key(velocityKeyX)], values[key(velocityKeyY)] = float64(car.VX), float64(car.VY)
+        }
+        if car.LastWriter != "" {
+            writers[lastWriterKey(car.ID)] = car.LastWriter
+            values[lastWriteAtKey(car.ID)] = float64(car.LastWriteAt)
+        }
+        if car.Seq > seq {
+            seq = car.Seq
+        }
+        // So the next snapshot saves it again, even if it never moves
+        broadcastCars.Store(car.ID, struct{}{})
+    }
+    // Seq goes last: once it is set the store no longer counts as empty
+    for k, writer := range writers {
+        if err := store.SetString(ctx, k, writer, 0); err != nil {
+            fatal("Could not restore the snapshot", "error", err)
+        }
+    }
+    if err := setNumbers(ctx, values); err != nil {
+        fatal("Could not restore the snapshot", "error", err)
+    }
+    if err := store.Set(ctx, map[string]int64{key(seqKey): seq}); err != nil {
+        fatal("Could not restore the snapshot", "error", err)
+    }
+    slog.Info("Restored the snapshot into the empty store",
+        "path", snapshotFile, "taken_at", snap.TakenAt, "cars", len(snap.Cars), "seq", seq)
+}
+
+// runSnapshots rewrites SNAPSHOT_FILE every snapshotInterval until ctx is
+// cancelled, then once more so a clean shutdown saves the latest state
+func runSnapshots(ctx context.Context) {
+    defer tasksWG.Done()
+
+    ticker := time.NewTicker(snapshotInterval)
+    defer ticker.Stop()
+
+    var lastSeq int64 = -1
+    for {
+        select {
+        case <-ctx.Done():
+            writeSnapshot(&lastSeq)
+            return
+        case <-ticker.C:
+            writeSnapshot(&lastSeq)
+        }
+    }
+}
+
+// writeSnapshot saves every known car's state to SNAPSHOT_FILE, unless seq
+// hasn't moved since *lastSeq was saved. The file is written to a temporary
+// file next to it and renamed over it, so a crash mid-write never leaves a
+// partial snapshot behind.
+func writeSnapshot(lastSeq *int64) {
+    ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+    defer cancel()
+
+    ids := []string{""}
+    broadcastCars.Range(func(id, _ interface{}) bool {
+        if id != "" {
+            ids = append(ids, id.(string))
+        }
+        return true
+    })
+
+    snap := Snapshot{TakenAt: time.Now().UTC(), Cars: make([]CarState, 0, len(ids))}
+    for _, id := range ids {
+        state, err := readState(ctx, id)
+        if err != nil {
+            slog.Error("Error reading state for the snapshot", "car_id", id, "error", err)
+            return
+        }
+        snap.Cars = append(snap.Cars, state)
+    }
+    // Every car reads the same global seq
+    seq := snap.Cars[0].Seq
+    if seq == *lastSeq {
+        return
+    }
+
+    data, err := json.MarshalIndent(snap, "", "  ")
+    if err != nil {
+        slog.Error("Error encoding the snapshot", "error", err)
+        return
+    }
+    if err := writeFileAtomic(snapshotFile, data); err != nil {
+        slog.Error("Error writing the snapshot", "path", snapshotFile, "error", err)
+        return
+    }
+    *lastSeq = seq
+    slog.Debug("Wrote snapshot", "path", snapshotFile, "cars", len(snap.Cars), "seq", seq)
+}
+
+// writeFileAtomic replaces path with data through a temporary file in the
+// same directory, which rename swaps in whole
+func writeFileAtomic(path string, data []byte) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
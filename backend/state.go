@@ -0,0 +1,86 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "strconv"
+)
+
+// -------------------- STATE -------------------- //
+
+// CarState is everything known about a car in one object. GET /state
+// returns it and WebSocket clients get it as their snapshot, so both have
+// the same shape. Velocity mirrors VX; only the original car has one.
+type CarState struct {
+    PositionResponse
+    Velocity    int    `json:"velocity"`
+    VX          int    `json:"vx"`
+    VY          int    `json:"vy"`
+    LastWriter  string `json:"lastWriter,omitempty"`  // Controller of the latest change; see writerMiddleware
+    LastWriteAt int64  `json:"lastWriteAt,omitempty"` // When it was made, in Unix milliseconds
+}
+
+// readState fetches car id's position, heading, velocity, last writer and
+// the current sequence number in a single MGET
+func readState(ctx context.Context, id string) (CarState, error) {
+    xKey, yKey := positionKeys(id)
+    keys := []string{lastWriterKey(id), xKey, yKey, headingKey(id), key(seqKey), lastWriteAtKey(id)}
+    if id == "" {
+        keys = append(keys, key(velocityKeyX), key(velocityKeyY))
+    }
+    keys = append(keys, lapsKey(id))
+    strs, err := store.GetStrings(ctx, keys...)
+    if err != nil {
+        return CarState{}, err
+    }
+    // Everything after the writer is a number; missing keys read as 0
+    vals := make([]float64, len(strs)-1)
+    for i, str := range strs[1:] {
+        if str == "" {
+            continue
+        }
+        if vals[i], err = strconv.ParseFloat(str, 64); err != nil {
+            return CarState{}, err
+        }
+    }
+
+    state := CarState{PositionResponse: newPositionResponse(id, vals[0], vals[1])}
+    state.Heading = normalizeHeading(int64(vals[2]))
+    state.Seq = int64(vals[3])
+    state.LastWriter = strs[0]
+    state.LastWriteAt = int64(vals[4])
+    if id == "" {
+        state.VX, state.VY = int(vals[5]), int(vals[6])
+        state.Velocity = state.VX
+    }
+    state.placeOnTrack(vals[len(vals)-1])
+    return state, nil
+}
+
+// getState returns the car's full state, saving clients from assembling it
+// from /position and /velocity
+func getState(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+
+    var state CarState
+    err := withReconnectRetry(ctx, func(ctx context.Context) (err error) {
+        state, err = readState(ctx, id)
+        return err
+    })
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    _ = json.NewEncoder(w).Encode(state)
+}
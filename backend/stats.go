@@ -0,0 +1,69 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "sync/atomic"
+    "time"
+)
+
+// -------------------- STATS -------------------- //
+
+// When main started, for GET /stats' uptime
+var startTime time.Time
+
+// Totals since start for GET /stats, for deployments without Prometheus
+var (
+    httpRequestsCount    atomic.Int64 // HTTP requests routed, WebSocket upgrades included
+    positionUpdatesCount atomic.Int64 // Position changes made by this instance
+    broadcastsCount      atomic.Int64 // Position changes sent to this instance's clients
+)
+
+// StatsResponse is returned by GET /stats. The totals are this instance's.
+type StatsResponse struct {
+    StartedAt       time.Time        `json:"startedAt"`
+    UptimeSeconds   float64          `json:"uptimeSeconds"`
+    HTTPRequests    int64            `json:"httpRequests"`
+    PositionUpdates int64            `json:"positionUpdates"`
+    Broadcasts      int64            `json:"broadcasts"`
+    Clients         int              `json:"clients"`
+    Position        PositionResponse `json:"position"`
+}
+
+// countRequestsMiddleware counts every routed request for GET /stats
+func countRequestsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        httpRequestsCount.Add(1)
+        next.ServeHTTP(w, r)
+    })
+}
+
+// getStats returns an overview of this instance: uptime, totals, connected
+// WebSocket clients and the original car's position
+func getStats(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    var pos PositionResponse
+    err := withReconnectRetry(ctx, func(ctx context.Context) (err error) {
+        pos, err = readPosition(ctx, "")
+        return err
+    })
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    _ = json.NewEncoder(w).Encode(StatsResponse{
+        StartedAt:       startTime,
+        UptimeSeconds:   time.Since(startTime).Seconds(),
+        HTTPRequests:    httpRequestsCount.Load(),
+        PositionUpdates: positionUpdatesCount.Load(),
+        Broadcasts:      broadcastsCount.Load(),
+        Clients:         clientCount(),
+        Position:        pos,
+    })
+}
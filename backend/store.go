@@ -0,0 +1,1488 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "math/rand"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// -------------------- STORE -------------------- //
+
+// Store is the shared state backend used by the handlers. Values are
+// numbers and missing keys read as 0. The integer calls fail on a key
+// holding a fraction, like Redis' INCRBY. Calls that take several keys
+// apply to all of them atomically.
+type Store interface {
+    // Get returns the values of keys, in order
+    Get(ctx context.Context, keys ...string) ([]int64, error)
+    // IncrBy adds each delta to its key and returns the new values. Each key
+    // in strs is set to its string first, in the same transaction, so a delta
+    // on one of them adds to its new value.
+    IncrBy(ctx context.Context, deltas map[string]int64, strs map[string]string) (map[string]int64, error)
+    // Set overwrites the given keys
+    Set(ctx context.Context, values map[string]int64) error
+    // GetFloat, IncrByFloat and SetFloat are the float64 forms of the above.
+    // Whole results are stored without a fraction, so the integer calls keep
+    // working on them.
+    GetFloat(ctx context.Context, keys ...string) ([]float64, error)
+    IncrByFloat(ctx context.Context, deltas map[string]float64, strs map[string]string) (map[string]float64, error)
+    SetFloat(ctx context.Context, values map[string]float64) error
+    // IncrByFloatSince stamps stampKey with now, in Unix milliseconds, and
+    // adds each rate times the seconds elapsed since the previous stamp,
+    // capped at maxElapsed, to its key, all in one step. If that moves no
+    // key, e.g. with no previous stamp, only the stamp is written and
+    // results is nil. Otherwise deltas and strs are applied as in
+    // IncrByFloat, a key in both maps gets both, and results has the new
+    // values. A stamp that isn't a number counts as none.
+    IncrByFloatSince(ctx context.Context, stampKey string, now time.Time, maxElapsed time.Duration, rates, deltas map[string]float64, strs map[string]string) (elapsed time.Duration, results map[string]float64, err error)
+
+    // IncrByFloatIfNewer sets the integer at stampKey to stamp and applies
+    // deltas and strs as IncrByFloat does, all in one step, unless stampKey
+    // already holds a larger integer, in which case nothing is written and
+    // fresh is false
+    IncrByFloatIfNewer(ctx context.Context, stampKey string, stamp int64, deltas map[string]float64, strs map[string]string) (results map[string]float64, fresh bool, err error)
+    // CompareAndSwap sets the number at key to value only if it holds
+    // expected, reporting whether it did and, if not, what it holds. On a
+    // swap it also adds deltas and sets strs in the same step, returning the
+    // new values like IncrByFloat.
+    CompareAndSwap(ctx context.Context, key string, expected, value float64, deltas map[string]float64, strs map[string]string) (current float64, results map[string]float64, swapped bool, err error)
+
+    // SetNX sets key to value with a TTL only if it doesn't exist, reporting
+    // whether it did. A zero TTL never expires, here and in SetString.
+    SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+    // SetString sets key to value with a TTL, overwriting any existing value
+    SetString(ctx context.Context, key, value string, ttl time.Duration) error
+    // GetString returns the value at key, with ok false if it is missing
+    GetString(ctx context.Context, key string) (value string, ok bool, err error)
+    // GetStrings returns the values of keys, in order, with "" for missing ones
+    GetStrings(ctx context.Context, keys ...string) ([]string, error)
+    // Delete removes keys; missing ones are ignored
+    Delete(ctx context.Context, keys ...string) error
+
+    // AddScored adds value to the sorted set at key, keeping the maxLen
+    // highest-scored items. Adding a value already present moves it.
+    AddScored(ctx context.Context, key, value string, score float64, maxLen int64) error
+    // ScoredTail returns up to the n highest-scored items at key, lowest first
+    ScoredTail(ctx context.Context, key string, n int64) ([]string, error)
+    // ScoredAfter returns up to limit items at key scored above min, lowest
+    // first, along with the lowest score at key and how many items it
+    // holds, all read at once
+    ScoredAfter(ctx context.Context, key string, min float64, limit int64) (values []string, oldest float64, size int64, err error)
+    // ScoredAtOrBefore returns the highest-scored item at key with a score
+    // of at most max, with ok false if there is none
+    ScoredAtOrBefore(ctx context.Context, key string, max float64) (value string, ok bool, err error)
+
+    // AppendStream adds value as a new entry of the stream at key, keeping
+    // roughly the maxLen latest entries
+    AppendStream(ctx context.Context, key, value string, maxLen int64) error
+    // StreamTail returns up to the n latest entries of the stream at key,
+    // oldest first
+    StreamTail(ctx context.Context, key string, n int64) ([]string, error)
+
+    // HashSet sets field of the hash at key to value
+    HashSet(ctx context.Context, key, field, value string) error
+    // HashGet returns field of the hash at key, with ok false if it is missing
+    HashGet(ctx context.Context, key, field string) (value string, ok bool, err error)
+
+    // Publish sends msg to every subscriber of channel
+    Publish(ctx context.Context, channel string, msg []byte) error
+    // Subscribe starts receiving messages published to channel
+    Subscribe(ctx context.Context, channel string) (Subscription, error)
+
+    // Pipeline starts a batch of writes sent in one round trip
+    Pipeline() Pipeline
+
+    Ping(ctx context.Context) error
+    Close() error
+}
+
+// CorruptValueError is returned by Get and GetFloat when keys hold values
+// that aren't numbers, e.g. after a manual SET in redis-cli. Values maps
+// each such key to what it holds.
+type CorruptValueError struct {
+    Values map[string]string
+}
+
+func (e *CorruptValueError) Error() string {
+    keys := make([]string, 0, len(e.Values))
+    for key := range e.Values {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    parts := make([]string, len(keys))
+    for i, key := range keys {
+        parts[i] = fmt.Sprintf("%s holds %q", key, e.Values[key])
+    }
+    return "corrupted value in store, not a number: " + strings.Join(parts, ", ")
+}
+
+// noteCorrupt records that key holds str, which isn't a number, in *errp
+func noteCorrupt(errp **CorruptValueError, key, str string) {
+    if *errp == nil {
+        *errp = &CorruptValueError{Values: make(map[string]string)}
+    }
+    (*errp).Values[key] = str
+}
+
+// Pipeline queues writes and sends them to the store together on Exec, in
+// order but not atomically. Each queueing call returns a func reporting
+// that write's own error, valid once Exec has returned.
+type Pipeline interface {
+    Set(ctx context.Context, values map[string]int64) func() error
+    SetFloat(ctx context.Context, values map[string]float64) func() error
+    IncrBy(ctx context.Context, deltas map[string]int64) func() error
+    IncrByFloat(ctx context.Context, deltas map[string]float64) func() error
+    AddScored(ctx context.Context, key, value string, score float64, maxLen int64) func() error
+    AppendStream(ctx context.Context, key, value string, maxLen int64) func() error
+    Publish(ctx context.Context, channel string, msg []byte) func() error
+    // Exec sends the queued writes, returning the first error if any
+    Exec(ctx context.Context) error
+}
+
+// Subscription delivers messages published to a channel
+type Subscription interface {
+    Messages() <-chan []byte
+    // Resumed receives a value each time the subscription is restored
+    // after losing its connection. Messages published meanwhile are lost.
+    Resumed() <-chan struct{}
+    Close() error
+}
+
+// newStore builds the backend named by STORE_BACKEND
+func newStore(backend string, opts *redis.Options) (Store, bool) {
+    switch backend {
+    case "", "redis":
+        return NewRedisStore(opts), true
+    case "memory":
+        return NewInMemoryStore(), true
+    }
+    return nil, false
+}
+
+// formatFloat formats f the way Redis' INCRBYFLOAT does: no exponent, and
+// no fraction for whole numbers
+func formatFloat(f float64) string {
+    return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// -------------------- REDIS STORE -------------------- //
+
+// RedisStore keeps state in Redis, so it is shared by every instance
+type RedisStore struct {
+    client *redis.Client
+}
+
+// NewRedisStore connects lazily to the Redis server described by opts
+func NewRedisStore(opts *redis.Options) *RedisStore {
+    client := redis.NewClient(opts)
+    client.AddHook(redisMetricsHook{})
+    return &RedisStore{client: client}
+}
+
+func (s *RedisStore) Get(ctx context.Context, keys ...string) ([]int64, error) {
+    vals, err := s.client.MGet(ctx, keys...).Result()
+    if err != nil {
+        return nil, err
+    }
+
+    ints := make([]int64, len(vals))
+    var corrupt *CorruptValueError
+    for i, v := range vals {
+        str, ok := v.(string)
+        if !ok {
+            // Key doesn't exist; leave as 0
+            continue
+        }
+        n, err := strconv.ParseInt(str, 10, 64)
+        if err != nil {
+            noteCorrupt(&corrupt, keys[i], str)
+            continue
+        }
+        ints[i] = n
+    }
+    if corrupt != nil {
+        return nil, corrupt
+    }
+    return ints, nil
+}
+
+func (s *RedisStore) IncrBy(ctx context.Context, deltas map[string]int64, strs map[string]string) (map[string]int64, error) {
+    pipe := s.client.TxPipeline()
+    for key, value := range strs {
+        pipe.Set(ctx, key, value, 0)
+    }
+    cmds := make(map[string]*redis.IntCmd, len(deltas))
+    for key, delta := range deltas {
+        cmds[key] = pipe.IncrBy(ctx, key, delta)
+    }
+    if _, err := pipe.Exec(ctx); err != nil {
+        return nil, err
+    }
+
+    result := make(map[string]int64, len(cmds))
+    for key, cmd := range cmds {
+        result[key] = cmd.Val()
+    }
+    return result, nil
+}
+
+func (s *RedisStore) Set(ctx context.Context, values map[string]int64) error {
+    pairs := make([]interface{}, 0, 2*len(values))
+    for key, value := range values {
+        pairs = append(pairs, key, value)
+    }
+    return s.client.MSet(ctx, pairs...).Err()
+}
+
+func (s *RedisStore) GetFloat(ctx context.Context, keys ...string) ([]float64, error) {
+    vals, err := s.client.MGet(ctx, keys...).Result()
+    if err != nil {
+        return nil, err
+    }
+
+    floats := make([]float64, len(vals))
+    var corrupt *CorruptValueError
+    for i, v := range vals {
+        str, ok := v.(string)
+        if !ok {
+            // Key doesn't exist; leave as 0
+            continue
+        }
+        f, err := strconv.ParseFloat(str, 64)
+        if err != nil {
+            noteCorrupt(&corrupt, keys[i], str)
+            continue
+        }
+        floats[i] = f
+    }
+    if corrupt != nil {
+        return nil, corrupt
+    }
+    return floats, nil
+}
+
+func (s *RedisStore) IncrByFloat(ctx context.Context, deltas map[string]float64, strs map[string]string) (map[string]float64, error) {
+    pipe := s.client.TxPipeline()
+    for key, value := range strs {
+        pipe.Set(ctx, key, value, 0)
+    }
+    cmds := make(map[string]*redis.FloatCmd, len(deltas))
+    for key, delta := range deltas {
+        cmds[key] = pipe.IncrByFloat(ctx, key, delta)
+    }
+    if _, err := pipe.Exec(ctx); err != nil {
+        return nil, err
+    }
+
+    result := make(map[string]float64, len(cmds))
+    for key, cmd := range cmds {
+        result[key] = cmd.Val()
+    }
+    return result, nil
+}
+
+func (s *RedisStore) SetFloat(ctx context.Context, values map[string]float64) error {
+    pairs := make([]interface{}, 0, 2*len(values))
+    for key, value := range values {
+        pairs = append(pairs, key, formatFloat(value))
+    }
+    return s.client.MSet(ctx, pairs...).Err()
+}
+
+// advanceScript is IncrByFloatIfNewer as one atomic step. KEYS[1] is the
+// stamp, then come ARGV[2] keys to increment by ARGV[3]... and then the keys
+// to set to the strings after those. As in casScript, every key is checked
+// before anything is written.
+var advanceScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]))
+if current and current > tonumber(ARGV[1]) then
+    return {0}
+end
+local n = tonumber(ARGV[2])
+for i = 2, n + 1 do
+    local v = redis.call("GET", KEYS[i])
+    if v and not tonumber(v) then
+        return redis.error_reply("ERR value is not a valid float")
+    end
+end
+redis.call("SET", KEYS[1], ARGV[1])
+for i = n + 2, #KEYS do
+    redis.call("SET", KEYS[i], ARGV[i + 1])
+end
+local res = {1}
+for i = 2, n + 1 do
+    res[#res + 1] = redis.call("INCRBYFLOAT", KEYS[i], ARGV[i + 1])
+end
+return res
+`)
+
+func (s *RedisStore) IncrByFloatIfNewer(ctx context.Context, stampKey string, stamp int64, deltas map[string]float64, strs map[string]string) (map[string]float64, bool, error) {
+    keys := make([]string, 0, 1+len(deltas)+len(strs))
+    args := make([]interface{}, 0, 2+len(deltas)+len(strs))
+    keys = append(keys, stampKey)
+    args = append(args, stamp, len(deltas))
+    for k, delta := range deltas {
+        keys = append(keys, k)
+        args = append(args, formatFloat(delta))
+    }
+    for k, v := range strs {
+        keys = append(keys, k)
+        args = append(args, v)
+    }
+
+    res, err := advanceScript.Run(ctx, s.client, keys, args...).Slice()
+    if err != nil {
+        return nil, false, err
+    }
+    if fresh, _ := res[0].(int64); fresh != 1 {
+        return nil, false, nil
+    }
+
+    result := make(map[string]float64, len(deltas))
+    for i, k := range keys[1 : 1+len(deltas)] {
+        str, _ := res[1+i].(string)
+        if result[k], err = strconv.ParseFloat(str, 64); err != nil {
+            return nil, false, err
+        }
+    }
+    return result, true, nil
+}
+
+// casScript is CompareAndSwap as one atomic step. Missing keys hold 0, and
+// a value that isn't a number fails like INCRBYFLOAT on it. KEYS[1] is the
+// key compared, then come ARGV[3] keys to increment by ARGV[4]... and then
+// the keys to set to the strings after those. Every increment is checked
+// before anything is written, since a script that fails midway keeps the
+// writes it made.
+var casScript = redis.NewScript(`
+local raw = redis.call("GET", KEYS[1])
+local current = 0
+if raw then
+    current = tonumber(raw)
+    if not current then
+        return redis.error_reply("ERR value is not a valid float")
+    end
+end
+if current ~= tonumber(ARGV[1]) then
+    return {0, raw or "0"}
+end
+local n = tonumber(ARGV[3])
+for i = 2, n + 1 do
+    local v = redis.call("GET", KEYS[i])
+    if v and not tonumber(v) then
+        return redis.error_reply("ERR value is not a valid float")
+    end
+end
+redis.call("SET", KEYS[1], ARGV[2])
+for i = n + 2, #KEYS do
+    redis.call("SET", KEYS[i], ARGV[i + 2])
+end
+local res = {1, ARGV[2]}
+for i = 2, n + 1 do
+    res[#res + 1] = redis.call("INCRBYFLOAT", KEYS[i], ARGV[i + 2])
+end
+return res
+`)
+
+func (s *RedisStore) CompareAndSwap(ctx context.Context, key string, expected, value float64, deltas map[string]float64, strs map[string]string) (float64, map[string]float64, bool, error) {
+    keys := make([]string, 0, 1+len(deltas)+len(strs))
+    args := make([]interface{}, 0, 3+len(deltas)+len(strs))
+    keys = append(keys, key)
+    args = append(args, formatFloat(expected), formatFloat(value), len(deltas))
+    for k, delta := range deltas {
+        keys = append(keys, k)
+        args = append(args, formatFloat(delta))
+    }
+    for k, v := range strs {
+        keys = append(keys, k)
+        args = append(args, v)
+    }
+
+    res, err := casScript.Run(ctx, s.client, keys, args...).Slice()
+    if err != nil {
+        return 0, nil, false, err
+    }
+    swapped, _ := res[0].(int64)
+    str, _ := res[1].(string)
+    current, err := strconv.ParseFloat(str, 64)
+    if err != nil || swapped != 1 {
+        return current, nil, false, err
+    }
+
+    result := make(map[string]float64, len(deltas))
+    for i, k := range keys[1 : 1+len(deltas)] {
+        str, _ := res[2+i].(string)
+        if result[k], err = strconv.ParseFloat(str, 64); err != nil {
+            return 0, nil, false, err
+        }
+    }
+    return current, result, true, nil
+}
+
+// sinceScript is IncrByFloatSince as one atomic step. KEYS[1] is the stamp,
+// then come ARGV[3] keys, each with its rate and delta at ARGV[2i] and
+// ARGV[2i+1], and then the keys to set to the strings after those. As in
+// casScript, every key is checked before anything is written.
+var sinceScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local prev = tonumber(redis.call("GET", KEYS[1]))
+local elapsed = 0
+if prev then
+    elapsed = math.max(0, math.min(now - prev, tonumber(ARGV[2])))
+end
+local n = tonumber(ARGV[3])
+local adds = {}
+local moved = false
+for i = 2, n + 1 do
+    local d = tonumber(ARGV[2 * i]) * elapsed / 1000
+    if d ~= 0 then
+        moved = true
+    end
+    adds[i] = d + tonumber(ARGV[2 * i + 1])
+end
+if moved then
+    for i = 2, n + 1 do
+        local v = redis.call("GET", KEYS[i])
+        if v and not tonumber(v) then
+            return redis.error_reply("ERR value is not a valid float")
+        end
+    end
+end
+redis.call("SET", KEYS[1], ARGV[1])
+if not moved then
+    return {elapsed}
+end
+for i = n + 2, #KEYS do
+    redis.call("SET", KEYS[i], ARGV[i + n + 2])
+end
+local res = {elapsed}
+for i = 2, n + 1 do
+    res[#res + 1] = redis.call("INCRBYFLOAT", KEYS[i], string.format("%.17g", adds[i]))
+end
+return res
+`)
+
+func (s *RedisStore) IncrByFloatSince(ctx context.Context, stampKey string, now time.Time, maxElapsed time.Duration, rates, deltas map[string]float64, strs map[string]string) (time.Duration, map[string]float64, error) {
+    incrKeys := make([]string, 0, len(rates)+len(deltas))
+    for k := range rates {
+        incrKeys = append(incrKeys, k)
+    }
+    for k := range deltas {
+        if _, ok := rates[k]; !ok {
+            incrKeys = append(incrKeys, k)
+        }
+    }
+    keys := make([]string, 0, 1+len(incrKeys)+len(strs))
+    args := make([]interface{}, 0, 3+2*len(incrKeys)+len(strs))
+    keys = append(keys, stampKey)
+    args = append(args, now.UnixMilli(), maxElapsed.Milliseconds(), len(incrKeys))
+    for _, k := range incrKeys {
+        keys = append(keys, k)
+        args = append(args, formatFloat(rates[k]), formatFloat(deltas[k]))
+    }
+    for k, v := range strs {
+        keys = append(keys, k)
+        args = append(args, v)
+    }
+
+    res, err := sinceScript.Run(ctx, s.client, keys, args...).Slice()
+    if err != nil {
+        return 0, nil, err
+    }
+    ms, _ := res[0].(int64)
+    elapsed := time.Duration(ms) * time.Millisecond
+    if len(res) == 1 {
+        return elapsed, nil, nil
+    }
+
+    result := make(map[string]float64, len(incrKeys))
+    for i, k := range incrKeys {
+        str, _ := res[1+i].(string)
+        if result[k], err = strconv.ParseFloat(str, 64); err != nil {
+            return 0, nil, err
+        }
+    }
+    return elapsed, result, nil
+}
+
+func (s *RedisStore) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+    return s.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (s *RedisStore) SetString(ctx context.Context, key, value string, ttl time.Duration) error {
+    return s.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (s *RedisStore) GetString(ctx context.Context, key string) (string, bool, error) {
+    value, err := s.client.Get(ctx, key).Result()
+    if err == redis.Nil {
+        return "", false, nil
+    }
+    if err != nil {
+        return "", false, err
+    }
+    return value, true, nil
+}
+
+func (s *RedisStore) GetStrings(ctx context.Context, keys ...string) ([]string, error) {
+    vals, err := s.client.MGet(ctx, keys...).Result()
+    if err != nil {
+        return nil, err
+    }
+
+    strs := make([]string, len(vals))
+    for i, v := range vals {
+        // Missing keys come back as nil; leave as ""
+        strs[i], _ = v.(string)
+    }
+    return strs, nil
+}
+
+func (s *RedisStore) Delete(ctx context.Context, keys ...string) error {
+    return s.client.Del(ctx, keys...).Err()
+}
+
+func (s *RedisStore) AddScored(ctx context.Context, key, value string, score float64, maxLen int64) error {
+    pipe := s.client.Pipeline()
+    pipe.ZAdd(ctx, key, redis.Z{Score: score, Member: value})
+    pipe.ZRemRangeByRank(ctx, key, 0, -maxLen-1)
+    _, err := pipe.Exec(ctx)
+    return err
+}
+
+func (s *RedisStore) ScoredTail(ctx context.Context, key string, n int64) ([]string, error) {
+    return s.client.ZRange(ctx, key, -n, -1).Result()
+}
+
+func (s *RedisStore) ScoredAfter(ctx context.Context, key string, min float64, limit int64) ([]string, float64, int64, error) {
+    pipe := s.client.TxPipeline()
+    first := pipe.ZRangeWithScores(ctx, key, 0, 0)
+    size := pipe.ZCard(ctx, key)
+    after := pipe.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+        Min:   "(" + formatFloat(min),
+        Max:   "+inf",
+        Count: limit,
+    })
+    if _, err := pipe.Exec(ctx); err != nil {
+        return nil, 0, 0, err
+    }
+
+    var oldest float64
+    if items := first.Val(); len(items) > 0 {
+        oldest = items[0].Score
+    }
+    return after.Val(), oldest, size.Val(), nil
+}
+
+func (s *RedisStore) ScoredAtOrBefore(ctx context.Context, key string, max float64) (string, bool, error) {
+    vals, err := s.client.ZRevRangeByScore(ctx, key, &redis.ZRangeBy{
+        Max:   formatFloat(max),
+        Min:   "-inf",
+        Count: 1,
+    }).Result()
+    if err != nil || len(vals) == 0 {
+        return "", false, err
+    }
+    return vals[0], true, nil
+}
+
+// streamField is the field holding each stream entry's value
+const streamField = "value"
+
+func (s *RedisStore) AppendStream(ctx context.Context, key, value string, maxLen int64) error {
+    return s.client.XAdd(ctx, streamArgs(key, value, maxLen)).Err()
+}
+
+// streamArgs is the XADD of value to key, trimmed with MAXLEN ~ maxLen so
+// Redis can drop whole nodes rather than single entries
+func streamArgs(key, value string, maxLen int64) *redis.XAddArgs {
+    return &redis.XAddArgs{
+        Stream: key,
+        MaxLen: maxLen,
+        Approx: true,
+        Values: []interface{}{streamField, value},
+    }
+}
+
+func (s *RedisStore) StreamTail(ctx context.Context, key string, n int64) ([]string, error) {
+    msgs, err := s.client.XRevRangeN(ctx, key, "+", "-", n).Result()
+    if err != nil {
+        return nil, err
+    }
+    values := make([]string, 0, len(msgs))
+    for i := len(msgs) - 1; i >= 0; i-- {
+        if value, ok := msgs[i].Values[streamField].(string); ok {
+            values = append(values, value)
+        }
+    }
+    return values, nil
+}
+
+func (s *RedisStore) HashSet(ctx context.Context, key, field, value string) error {
+    return s.client.HSet(ctx, key, field, value).Err()
+}
+
+func (s *RedisStore) HashGet(ctx context.Context, key, field string) (string, bool, error) {
+    value, err := s.client.HGet(ctx, key, field).Result()
+    if err == redis.Nil {
+        return "", false, nil
+    }
+    if err != nil {
+        return "", false, err
+    }
+    return value, true, nil
+}
+
+func (s *RedisStore) Publish(ctx context.Context, channel string, msg []byte) error {
+    return s.client.Publish(ctx, channel, msg).Err()
+}
+
+func (s *RedisStore) Subscribe(ctx context.Context, channel string) (Subscription, error) {
+    pubsub := s.client.Subscribe(ctx, channel)
+
+    // Wait for the subscription to be confirmed so no messages are missed
+    if _, err := pubsub.Receive(ctx); err != nil {
+        pubsub.Close()
+        return nil, err
+    }
+
+    sub := &redisSubscription{
+        pubsub:   pubsub,
+        messages: make(chan []byte),
+        resumed:  make(chan struct{}, 1),
+        done:     make(chan struct{}),
+    }
+    go sub.receive(channel)
+    return sub, nil
+}
+
+// Backoff between attempts to restore a lost subscription
+const (
+    subscribeBackoffMin = 100 * time.Millisecond
+    subscribeBackoffMax = 30 * time.Second
+)
+
+// How long the subscription may be idle before it pings Redis, so a dead
+// connection is noticed even when nothing is published
+const subscribeHealthInterval = 30 * time.Second
+
+// backoffDelay is the wait before reconnect attempt n (from 1): doubling
+// from subscribeBackoffMin up to subscribeBackoffMax, with the upper half
+// randomized so instances don't all retry at once
+func backoffDelay(attempt int) time.Duration {
+    d := subscribeBackoffMax
+    if attempt < 20 {
+        d = min(subscribeBackoffMin<<(attempt-1), subscribeBackoffMax)
+    }
+    return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (s *RedisStore) Pipeline() Pipeline {
+    return redisPipeline{pipe: s.client.Pipeline()}
+}
+
+func (s *RedisStore) Ping(ctx context.Context) error {
+    return s.client.Ping(ctx).Err()
+}
+
+func (s *RedisStore) Close() error {
+    return s.client.Close()
+}
+
+// redisSubscription adapts a go-redis PubSub to Subscription
+type redisSubscription struct {
+    pubsub    *redis.PubSub
+    messages  chan []byte
+    resumed   chan struct{}
+    done      chan struct{} // Closed by Close
+    closeOnce sync.Once
+}
+
+func (s *redisSubscription) Messages() <-chan []byte {
+    return s.messages
+}
+
+func (s *redisSubscription) Resumed() <-chan struct{} {
+    return s.resumed
+}
+
+func (s *redisSubscription) Close() error {
+    s.closeOnce.Do(func() { close(s.done) })
+    return s.pubsub.Close()
+}
+
+// receive forwards messages until Close. When Redis goes away it retries
+// with backoff; go-redis reconnects and resubscribes on the next Receive.
+func (s *redisSubscription) receive(channel string) {
+    defer close(s.messages)
+    ctx := context.Background()
+    attempt := 0
+    for {
+        msg, err := s.pubsub.ReceiveTimeout(ctx, subscribeHealthInterval)
+        var netErr net.Error
+        if errors.As(err, &netErr) && netErr.Timeout() {
+            // Idle; the next Receive reports the ping's result
+            err = s.pubsub.Ping(ctx)
+        }
+        if err != nil {
+            select {
+            case <-s.done:
+                return
+            default:
+            }
+            attempt++
+            delay := backoffDelay(attempt)
+            slog.Warn("Lost position subscription, reconnecting",
+                "channel", channel, "attempt", attempt, "retry_in", delay.String(), "error", err)
+            select {
+            case <-s.done:
+                return
+            case <-time.After(delay):
+            }
+            continue
+        }
+
+        switch m := msg.(type) {
+        case *redis.Subscription:
+            // Sent when go-redis resubscribes after reconnecting
+            if attempt > 0 {
+                slog.Info("Position subscription restored", "channel", channel, "attempts", attempt)
+                attempt = 0
+                select {
+                case s.resumed <- struct{}{}:
+                default: // A resync is already pending
+                }
+            }
+        case *redis.Message:
+            select {
+            case s.messages <- []byte(m.Payload):
+            case <-s.done:
+                return
+            }
+        }
+    }
+}
+
+// redisPipeline is a Pipeline over a go-redis pipeline. The returned funcs
+// are the commands' Err methods, which only hold a result after Exec.
+type redisPipeline struct {
+    pipe redis.Pipeliner
+}
+
+func (p redisPipeline) Set(ctx context.Context, values map[string]int64) func() error {
+    pairs := make([]interface{}, 0, 2*len(values))
+    for key, value := range values {
+        pairs = append(pairs, key, value)
+    }
+    return p.pipe.MSet(ctx, pairs...).Err
+}
+
+func (p redisPipeline) SetFloat(ctx context.Context, values map[string]float64) func() error {
+    pairs := make([]interface{}, 0, 2*len(values))
+    for key, value := range values {
+        pairs = append(pairs, key, formatFloat(value))
+    }
+    return p.pipe.MSet(ctx, pairs...).Err
+}
+
+func (p redisPipeline) IncrBy(ctx context.Context, deltas map[string]int64) func() error {
+    cmds := make([]*redis.IntCmd, 0, len(deltas))
+    for key, delta := range deltas {
+        cmds = append(cmds, p.pipe.IncrBy(ctx, key, delta))
+    }
+    return func() error {
+        for _, cmd := range cmds {
+            if err := cmd.Err(); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+}
+
+func (p redisPipeline) IncrByFloat(ctx context.Context, deltas map[string]float64) func() error {
+    cmds := make([]*redis.FloatCmd, 0, len(deltas))
+    for key, delta := range deltas {
+        cmds = append(cmds, p.pipe.IncrByFloat(ctx, key, delta))
+    }
+    return func() error {
+        for _, cmd := range cmds {
+            if err := cmd.Err(); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+}
+
+func (p redisPipeline) AddScored(ctx context.Context, key, value string, score float64, maxLen int64) func() error {
+    add := p.pipe.ZAdd(ctx, key, redis.Z{Score: score, Member: value})
+    trim := p.pipe.ZRemRangeByRank(ctx, key, 0, -maxLen-1)
+    return func() error {
+        if err := add.Err(); err != nil {
+            return err
+        }
+        return trim.Err()
+    }
+}
+
+func (p redisPipeline) AppendStream(ctx context.Context, key, value string, maxLen int64) func() error {
+    return p.pipe.XAdd(ctx, streamArgs(key, value, maxLen)).Err
+}
+
+func (p redisPipeline) Publish(ctx context.Context, channel string, msg []byte) func() error {
+    return p.pipe.Publish(ctx, channel, msg).Err
+}
+
+func (p redisPipeline) Exec(ctx context.Context) error {
+    _, err := p.pipe.Exec(ctx)
+    return err
+}
+
+// -------------------- IN-MEMORY STORE -------------------- //
+
+// InMemoryStore keeps state in this process only. It doesn't sync across
+// instances, which is fine for local development.
+type InMemoryStore struct {
+    mu          sync.Mutex
+    values      map[string]string // Numbers formatted like Redis stores them
+    expiries    map[string]time.Time // For values set with a TTL
+    sorted      map[string][]scoredItem // Each ordered by score, then value
+    streams     map[string][]string     // Entries oldest first
+    hashes      map[string]map[string]string
+    subscribers map[string][]*memorySubscription
+}
+
+// NewInMemoryStore returns an empty InMemoryStore
+func NewInMemoryStore() *InMemoryStore {
+    return &InMemoryStore{
+        values:      make(map[string]string),
+        expiries:    make(map[string]time.Time),
+        sorted:      make(map[string][]scoredItem),
+        streams:     make(map[string][]string),
+        hashes:      make(map[string]map[string]string),
+        subscribers: make(map[string][]*memorySubscription),
+    }
+}
+
+func (s *InMemoryStore) Get(ctx context.Context, keys ...string) ([]int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ints := make([]int64, len(keys))
+    var corrupt *CorruptValueError
+    for i, key := range keys {
+        n, err := s.intLocked(key)
+        if err != nil {
+            noteCorrupt(&corrupt, key, s.values[key])
+            continue
+        }
+        ints[i] = n
+    }
+    if corrupt != nil {
+        return nil, corrupt
+    }
+    return ints, nil
+}
+
+func (s *InMemoryStore) IncrBy(ctx context.Context, deltas map[string]int64, strs map[string]string) (map[string]int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    // Check every key first so a failure leaves nothing half-applied. Keys
+    // in strs count with their new value.
+    result := make(map[string]int64, len(deltas))
+    for key, delta := range deltas {
+        n, err := s.intLocked(key)
+        if str, ok := strs[key]; ok {
+            n, err = parseStoredInt(str)
+        }
+        if err != nil {
+            return nil, err
+        }
+        result[key] = n + delta
+    }
+    s.setStringsLocked(strs)
+    for key, n := range result {
+        s.values[key] = strconv.FormatInt(n, 10)
+    }
+    return result, nil
+}
+
+func (s *InMemoryStore) Set(ctx context.Context, values map[string]int64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for key, value := range values {
+        s.values[key] = strconv.FormatInt(value, 10)
+    }
+    return nil
+}
+
+func (s *InMemoryStore) GetFloat(ctx context.Context, keys ...string) ([]float64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    floats := make([]float64, len(keys))
+    var corrupt *CorruptValueError
+    for i, key := range keys {
+        f, err := s.floatLocked(key)
+        if err != nil {
+            noteCorrupt(&corrupt, key, s.values[key])
+            continue
+        }
+        floats[i] = f
+    }
+    if corrupt != nil {
+        return nil, corrupt
+    }
+    return floats, nil
+}
+
+func (s *InMemoryStore) IncrByFloat(ctx context.Context, deltas map[string]float64, strs map[string]string) (map[string]float64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    result := make(map[string]float64, len(deltas))
+    for key, delta := range deltas {
+        f, err := s.floatLocked(key)
+        if str, ok := strs[key]; ok {
+            f, err = parseStoredFloat(str)
+        }
+        if err != nil {
+            return nil, err
+        }
+        result[key] = f + delta
+    }
+    s.setStringsLocked(strs)
+    for key, f := range result {
+        s.values[key] = formatFloat(f)
+    }
+    return result, nil
+}
+
+// setStringsLocked sets each key in strs, without a TTL. The caller must
+// hold s.mu.
+func (s *InMemoryStore) setStringsLocked(strs map[string]string) {
+    for key, value := range strs {
+        s.values[key] = value
+        delete(s.expiries, key)
+    }
+}
+
+func (s *InMemoryStore) SetFloat(ctx context.Context, values map[string]float64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for key, value := range values {
+        s.values[key] = formatFloat(value)
+    }
+    return nil
+}
+
+// intLocked parses the integer at key; missing keys are 0. The caller must hold s.mu.
+func (s *InMemoryStore) intLocked(key string) (int64, error) {
+    str, ok := s.values[key]
+    if !ok {
+        return 0, nil
+    }
+    return parseStoredInt(str)
+}
+
+// parseStoredInt parses an integer value, failing like INCRBY on anything else
+func parseStoredInt(str string) (int64, error) {
+    n, err := strconv.ParseInt(str, 10, 64)
+    if err != nil {
+        return 0, errors.New("value is not an integer or out of range")
+    }
+    return n, nil
+}
+
+// floatLocked parses the number at key; missing keys are 0. The caller must hold s.mu.
+func (s *InMemoryStore) floatLocked(key string) (float64, error) {
+    str, ok := s.values[key]
+    if !ok {
+        return 0, nil
+    }
+    return parseStoredFloat(str)
+}
+
+// parseStoredFloat parses a number, failing like INCRBYFLOAT on anything else
+func parseStoredFloat(str string) (float64, error) {
+    f, err := strconv.ParseFloat(str, 64)
+    if err != nil {
+        return 0, errors.New("value is not a valid float")
+    }
+    return f, nil
+}
+
+func (s *InMemoryStore) IncrByFloatIfNewer(ctx context.Context, stampKey string, stamp int64, deltas map[string]float64, strs map[string]string) (map[string]float64, bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.values[stampKey]; ok {
+        current, err := s.intLocked(stampKey)
+        if err != nil {
+            return nil, false, err
+        }
+        if current > stamp {
+            return nil, false, nil
+        }
+    }
+    result := make(map[string]float64, len(deltas))
+    for k, delta := range deltas {
+        f, err := s.floatLocked(k)
+        if err != nil {
+            return nil, false, err
+        }
+        result[k] = f + delta
+    }
+    s.values[stampKey] = strconv.FormatInt(stamp, 10)
+    s.setStringsLocked(strs)
+    for k, f := range result {
+        s.values[k] = formatFloat(f)
+    }
+    return result, true, nil
+}
+
+func (s *InMemoryStore) CompareAndSwap(ctx context.Context, key string, expected, value float64, deltas map[string]float64, strs map[string]string) (float64, map[string]float64, bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    current, err := s.floatLocked(key)
+    if err != nil {
+        return 0, nil, false, err
+    }
+    if current != expected {
+        return current, nil, false, nil
+    }
+    result := make(map[string]float64, len(deltas))
+    for k, delta := range deltas {
+        f, err := s.floatLocked(k)
+        if err != nil {
+            return 0, nil, false, err
+        }
+        result[k] = f + delta
+    }
+    s.values[key] = formatFloat(value)
+    s.setStringsLocked(strs)
+    for k, f := range result {
+        s.values[k] = formatFloat(f)
+    }
+    return value, result, true, nil
+}
+
+func (s *InMemoryStore) IncrByFloatSince(ctx context.Context, stampKey string, now time.Time, maxElapsed time.Duration, rates, deltas map[string]float64, strs map[string]string) (time.Duration, map[string]float64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.expireLocked()
+    var elapsed time.Duration
+    if prev, err := strconv.ParseInt(s.values[stampKey], 10, 64); err == nil {
+        elapsed = time.Duration(now.UnixMilli()-prev) * time.Millisecond
+        elapsed = max(0, min(elapsed, maxElapsed))
+    }
+    moved := false
+    for _, rate := range rates {
+        if rate*elapsed.Seconds() != 0 {
+            moved = true
+        }
+    }
+
+    var result map[string]float64
+    if moved {
+        result = make(map[string]float64, len(rates)+len(deltas))
+        for _, adds := range []map[string]float64{rates, deltas} {
+            for k := range adds {
+                if _, done := result[k]; done {
+                    continue
+                }
+                f, err := s.floatLocked(k)
+                if err != nil {
+                    return 0, nil, err
+                }
+                result[k] = f + rates[k]*elapsed.Seconds() + deltas[k]
+            }
+        }
+    }
+    s.values[stampKey] = strconv.FormatInt(now.UnixMilli(), 10)
+    delete(s.expiries, stampKey)
+    if !moved {
+        return elapsed, nil, nil
+    }
+    s.setStringsLocked(strs)
+    for k, f := range result {
+        s.values[k] = formatFloat(f)
+    }
+    return elapsed, result, nil
+}
+
+func (s *InMemoryStore) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.expireLocked()
+    if _, ok := s.values[key]; ok {
+        return false, nil
+    }
+    s.values[key] = value
+    s.setExpiryLocked(key, ttl)
+    return true, nil
+}
+
+func (s *InMemoryStore) SetString(ctx context.Context, key, value string, ttl time.Duration) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.values[key] = value
+    s.setExpiryLocked(key, ttl)
+    return nil
+}
+
+// setExpiryLocked makes key expire after ttl, or never if ttl is 0. The
+// caller must hold s.mu.
+func (s *InMemoryStore) setExpiryLocked(key string, ttl time.Duration) {
+    if ttl > 0 {
+        s.expiries[key] = time.Now().Add(ttl)
+    } else {
+        delete(s.expiries, key)
+    }
+}
+
+func (s *InMemoryStore) GetString(ctx context.Context, key string) (string, bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.expireLocked()
+    value, ok := s.values[key]
+    return value, ok, nil
+}
+
+func (s *InMemoryStore) GetStrings(ctx context.Context, keys ...string) ([]string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.expireLocked()
+    strs := make([]string, len(keys))
+    for i, key := range keys {
+        strs[i] = s.values[key]
+    }
+    return strs, nil
+}
+
+func (s *InMemoryStore) Delete(ctx context.Context, keys ...string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for _, key := range keys {
+        delete(s.values, key)
+        delete(s.expiries, key)
+        delete(s.sorted, key)
+        delete(s.streams, key)
+        delete(s.hashes, key)
+    }
+    return nil
+}
+
+// expireLocked drops values whose TTL has passed, so the maps don't grow
+// forever. The caller must hold s.mu.
+func (s *InMemoryStore) expireLocked() {
+    now := time.Now()
+    for key, expiry := range s.expiries {
+        if !now.Before(expiry) {
+            delete(s.values, key)
+            delete(s.expiries, key)
+        }
+    }
+}
+
+// scoredItem is one member of an in-memory sorted set
+type scoredItem struct {
+    score float64
+    value string
+}
+
+// less orders items like Redis does: by score, ties broken by value
+func (a scoredItem) less(b scoredItem) bool {
+    return a.score < b.score || (a.score == b.score && a.value < b.value)
+}
+
+func (s *InMemoryStore) AddScored(ctx context.Context, key, value string, score float64, maxLen int64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    set := s.sorted[key]
+    for i, item := range set {
+        if item.value == value {
+            set = append(set[:i], set[i+1:]...)
+            break
+        }
+    }
+    // History arrives in time order, so this is nearly always an append
+    item := scoredItem{score: score, value: value}
+    i := sort.Search(len(set), func(i int) bool { return item.less(set[i]) })
+    set = append(set, scoredItem{})
+    copy(set[i+1:], set[i:])
+    set[i] = item
+    if int64(len(set)) > maxLen {
+        set = append([]scoredItem(nil), set[int64(len(set))-maxLen:]...)
+    }
+    s.sorted[key] = set
+    return nil
+}
+
+func (s *InMemoryStore) ScoredTail(ctx context.Context, key string, n int64) ([]string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    set := s.sorted[key]
+    if int64(len(set)) > n {
+        set = set[int64(len(set))-n:]
+    }
+    values := make([]string, len(set))
+    for i, item := range set {
+        values[i] = item.value
+    }
+    return values, nil
+}
+
+func (s *InMemoryStore) ScoredAfter(ctx context.Context, key string, min float64, limit int64) ([]string, float64, int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    set := s.sorted[key]
+    var oldest float64
+    if len(set) > 0 {
+        oldest = set[0].score
+    }
+    after := set[sort.Search(len(set), func(i int) bool { return set[i].score > min }):]
+    if int64(len(after)) > limit {
+        after = after[:limit]
+    }
+    values := make([]string, len(after))
+    for i, item := range after {
+        values[i] = item.value
+    }
+    return values, oldest, int64(len(set)), nil
+}
+
+func (s *InMemoryStore) ScoredAtOrBefore(ctx context.Context, key string, max float64) (string, bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    set := s.sorted[key]
+    i := sort.Search(len(set), func(i int) bool { return set[i].score > max })
+    if i == 0 {
+        return "", false, nil
+    }
+    return set[i-1].value, true, nil
+}
+
+// AppendStream trims the stream to exactly maxLen entries
+func (s *InMemoryStore) AppendStream(ctx context.Context, key, value string, maxLen int64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stream := append(s.streams[key], value)
+    if int64(len(stream)) > maxLen {
+        stream = append([]string(nil), stream[int64(len(stream))-maxLen:]...)
+    }
+    s.streams[key] = stream
+    return nil
+}
+
+func (s *InMemoryStore) StreamTail(ctx context.Context, key string, n int64) ([]string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stream := s.streams[key]
+    if int64(len(stream)) > n {
+        stream = stream[int64(len(stream))-n:]
+    }
+    return append([]string{}, stream...), nil
+}
+
+func (s *InMemoryStore) HashSet(ctx context.Context, key, field, value string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.hashes[key] == nil {
+        s.hashes[key] = make(map[string]string)
+    }
+    s.hashes[key][field] = value
+    return nil
+}
+
+func (s *InMemoryStore) HashGet(ctx context.Context, key, field string) (string, bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    value, ok := s.hashes[key][field]
+    return value, ok, nil
+}
+
+func (s *InMemoryStore) Publish(ctx context.Context, channel string, msg []byte) error {
+    s.mu.Lock()
+    subs := append([]*memorySubscription(nil), s.subscribers[channel]...)
+    s.mu.Unlock()
+
+    for _, sub := range subs {
+        sub.deliver(msg)
+    }
+    return nil
+}
+
+func (s *InMemoryStore) Subscribe(ctx context.Context, channel string) (Subscription, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    sub := &memorySubscription{
+        store:    s,
+        channel:  channel,
+        messages: make(chan []byte, sendBufferSize),
+        done:     make(chan struct{}),
+    }
+    s.subscribers[channel] = append(s.subscribers[channel], sub)
+    return sub, nil
+}
+
+func (s *InMemoryStore) Pipeline() Pipeline {
+    return &memoryPipeline{store: s}
+}
+
+func (s *InMemoryStore) Ping(ctx context.Context) error {
+    return nil
+}
+
+func (s *InMemoryStore) Close() error {
+    return nil
+}
+
+// memorySubscription is an in-process Subscription
+type memorySubscription struct {
+    store    *InMemoryStore
+    channel  string
+    mu       sync.Mutex // Protects messages and closed
+    messages chan []byte
+    closed   bool
+
+    // Closed by Close before it takes mu, to release a deliver blocked on a
+    // full messages that nobody reads any more
+    done     chan struct{}
+    stopOnce sync.Once
+}
+
+func (s *memorySubscription) Messages() <-chan []byte {
+    return s.messages
+}
+
+// Resumed never fires; an in-process subscription can't lose its connection
+func (s *memorySubscription) Resumed() <-chan struct{} {
+    return nil
+}
+
+// deliver queues msg unless the subscription has been closed, waiting for
+// room like a Redis subscriber would, until the subscription is closed
+func (s *memorySubscription) deliver(msg []byte) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return
+    }
+    select {
+    case s.messages <- msg:
+    case <-s.done:
+    }
+}
+
+func (s *memorySubscription) Close() error {
+    s.store.mu.Lock()
+    subs := s.store.subscribers[s.channel]
+    for i, sub := range subs {
+        if sub == s {
+            s.store.subscribers[s.channel] = append(subs[:i:i], subs[i+1:]...)
+            break
+        }
+    }
+    s.store.mu.Unlock()
+
+    s.stopOnce.Do(func() { close(s.done) })
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !s.closed {
+        s.closed = true
+        close(s.messages)
+    }
+    return nil
+}
+
+// memoryPipeline is a Pipeline that runs each queued write on Exec
+type memoryPipeline struct {
+    store *InMemoryStore
+    ops   []func() error
+}
+
+// queue adds op, returning a func reporting its error once it has run
+func (p *memoryPipeline) queue(op func() error) func() error {
+    var err error
+    p.ops = append(p.ops, func() error {
+        err = op()
+        return err
+    })
+    return func() error { return err }
+}
+
+func (p *memoryPipeline) Set(ctx context.Context, values map[string]int64) func() error {
+    return p.queue(func() error { return p.store.Set(ctx, values) })
+}
+
+func (p *memoryPipeline) SetFloat(ctx context.Context, values map[string]float64) func() error {
+    return p.queue(func() error { return p.store.SetFloat(ctx, values) })
+}
+
+func (p *memoryPipeline) IncrBy(ctx context.Context, deltas map[string]int64) func() error {
+    return p.queue(func() error {
+        _, err := p.store.IncrBy(ctx, deltas, nil)
+        return err
+    })
+}
+
+func (p *memoryPipeline) IncrByFloat(ctx context.Context, deltas map[string]float64) func() error {
+    return p.queue(func() error {
+        _, err := p.store.IncrByFloat(ctx, deltas, nil)
+        return err
+    })
+}
+
+func (p *memoryPipeline) AddScored(ctx context.Context, key, value string, score float64, maxLen int64) func() error {
+    return p.queue(func() error { return p.store.AddScored(ctx, key, value, score, maxLen) })
+}
+
+func (p *memoryPipeline) AppendStream(ctx context.Context, key, value string, maxLen int64) func() error {
+    return p.queue(func() error { return p.store.AppendStream(ctx, key, value, maxLen) })
+}
+
+func (p *memoryPipeline) Publish(ctx context.Context, channel string, msg []byte) func() error {
+    return p.queue(func() error { return p.store.Publish(ctx, channel, msg) })
+}
+
+func (p *memoryPipeline) Exec(ctx context.Context) error {
+    var first error
+    for _, op := range p.ops {
+        if err := op(); err != nil && first == nil {
+            first = err
+        }
+    }
+    p.ops = nil
+    return first
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+// TestMemorySubscriptionCloseUnblocksPublish closes a subscription whose
+// reader has stopped while a Publish waits on its full buffer
+func TestMemorySubscriptionCloseUnblocksPublish(t *testing.T) {
+    ctx := context.Background()
+    s := NewInMemoryStore()
+    sub, err := s.Subscribe(ctx, "updates")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < sendBufferSize; i++ {
+        if err := s.Publish(ctx, "updates", []byte("queued")); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    published := make(chan struct{})
+    go func() {
+        _ = s.Publish(ctx, "updates", []byte("blocked"))
+        close(published)
+    }()
+    // Let the Publish block on the full buffer
+    time.Sleep(10 * time.Millisecond)
+
+    closed := make(chan struct{})
+    go func() {
+        _ = sub.Close()
+        close(closed)
+    }()
+    for name, ch := range map[string]chan struct{}{"Close": closed, "Publish": published} {
+        select {
+        case <-ch:
+        case <-time.After(time.Second):
+            t.Fatalf("%s still blocked a second after Close", name)
+        }
+    }
+
+    if err := s.Publish(ctx, "updates", []byte("after")); err != nil {
+        t.Errorf("Publish after Close: %v", err)
+    }
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+// -------------------- SERVER-SENT EVENTS -------------------- //
+
+// sseClient is one GET /position/stream subscriber, following a single car
+type sseClient struct {
+    carID string
+    send  chan []byte // Closed when the stream is dropped or the server shuts down
+}
+
+// Active streams; protected by wsMutex so they are ordered with WebSocket
+// broadcasts and snapshots
+var sseClients = make(map[*sseClient]struct{})
+
+// Latest position fanned out for each car; protected by wsMutex. Streams and
+// polls read the store before taking the lock, and check this for a change
+// that slipped in between.
+var fannedOut = make(map[string]PositionResponse)
+
+// noteFanOutLocked records pos in fannedOut unless a newer position of its
+// car is already there. The caller must hold wsMutex.
+func noteFanOutLocked(pos PositionResponse) {
+    if latest, ok := fannedOut[pos.ID]; !ok || pos.Seq > latest.Seq {
+        fannedOut[pos.ID] = pos
+    }
+}
+
+// streamPosition sends the car's current position, then every change to it,
+// as Server-Sent Events until the client goes away
+func streamPosition(w http.ResponseWriter, r *http.Request) {
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+        return
+    }
+
+    ctx, cancel := requestContext(r)
+    pos, err := readPosition(ctx, id)
+    cancel()
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    // The snapshot is queued as we register, so no change is queued ahead
+    // of it. A change fanned out since the read goes first instead.
+    client := &sseClient{carID: id, send: make(chan []byte, sendBufferSize)}
+    wsMutex.Lock()
+    if latest, ok := fannedOut[id]; ok && latest.Seq > pos.Seq {
+        pos = latest
+    }
+    sseClients[client] = struct{}{}
+    if msg, ok := marshalMessage(r.Context(), "position", pos); ok {
+        client.send <- msg
+    }
+    wsMutex.Unlock()
+    defer removeStream(client)
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    // Comment lines keep proxies from closing an idle stream
+    ticker := time.NewTicker(pingInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case msg, ok := <-client.send:
+            if !ok {
+                return
+            }
+            if _, err := fmt.Fprintf(w, "data: %s\n\n", msg); err != nil {
+                slog.DebugContext(r.Context(), "Error writing to event stream", "error", err)
+                return
+            }
+            flusher.Flush()
+        case <-ticker.C:
+            if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+                return
+            }
+            flusher.Flush()
+        }
+    }
+}
+
+// enqueueStreamsLocked queues pos for every stream following its car. A
+// stream whose buffer is full is dropped, like a slow WebSocket client.
+// The caller must hold wsMutex.
+func enqueueStreamsLocked(pos PositionResponse) {
+    var msg []byte
+    for client := range sseClients {
+        if client.carID != pos.ID {
+            continue
+        }
+        if msg == nil {
+            var ok bool
+            if msg, ok = marshalMessage(context.Background(), "position", pos); !ok {
+                return
+            }
+        }
+        select {
+        case client.send <- msg:
+        default:
+            slog.Warn("Event stream buffer full, dropping stream", "car_id", pos.ID)
+            broadcastErrorsTotal.Inc()
+            removeStreamLocked(client)
+        }
+    }
+}
+
+// removeStream unregisters client if it is still registered
+func removeStream(client *sseClient) {
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+    removeStreamLocked(client)
+}
+
+// removeStreamLocked unregisters client and closes its send channel, ending
+// the stream. The caller must hold wsMutex.
+func removeStreamLocked(client *sseClient) {
+    if _, ok := sseClients[client]; !ok {
+        return
+    }
+    delete(sseClients, client)
+    close(client.send)
+}
+
+// closeAllStreams ends every open stream. It runs when the server starts
+// shutting down, since server.Shutdown would otherwise wait for them.
+func closeAllStreams() {
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+    for client := range sseClients {
+        removeStreamLocked(client)
+    }
+}
@@ -0,0 +1,38 @@
+package main
+
+import "log/slog"
+
+// -------------------- CAR SUBSCRIPTIONS -------------------- //
+
+// subscribeClient limits the client's position broadcasts to the cars in
+// ids, replacing any earlier subscription. "" is the original car. An empty
+// list goes back to every car, the default for clients that never subscribe.
+// Invalid or too many IDs leave the subscription as it was.
+func subscribeClient(client *wsClient, ids []string) {
+    if len(ids) > carsMax {
+        slog.Warn("Ignoring subscription to too many cars", "client_id", client.id, "cars", len(ids), "max", carsMax)
+        return
+    }
+    var cars map[string]bool
+    if len(ids) > 0 {
+        cars = make(map[string]bool, len(ids))
+    }
+    for _, id := range ids {
+        if id != "" && !carIDPattern.MatchString(id) {
+            slog.Warn("Ignoring subscription with an invalid car id", "client_id", client.id, "car_id", id)
+            return
+        }
+        cars[id] = true
+    }
+
+    wsMutex.Lock()
+    client.cars = cars
+    wsMutex.Unlock()
+    slog.Debug("WebSocket client subscribed", "client_id", client.id, "cars", ids)
+}
+
+// watchesLocked reports whether the client gets car id's position updates.
+// The caller must hold wsMutex.
+func (c *wsClient) watchesLocked(id string) bool {
+    return c.cars == nil || c.cars[id]
+}
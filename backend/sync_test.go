@@ -0,0 +1,53 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "testing"
+)
+
+// TestSendCurrentPositionPrefersFannedOut checks that a sync snapshot read
+// before a change was fanned out goes out with that change's position
+func TestSendCurrentPositionPrefersFannedOut(t *testing.T) {
+    prev := store
+    store = NewInMemoryStore()
+    t.Cleanup(func() { store = prev })
+
+    ctx := context.Background()
+    if err := store.Set(ctx, map[string]int64{key(positionKeyX): 3, key(seqKey): 5}); err != nil {
+        t.Fatal(err)
+    }
+    client := registerTestClient(t, "sync", 2)
+
+    for _, tc := range []struct {
+        name    string
+        fanned  *PositionResponse
+        wantX   float64
+        wantSeq int64
+    }{
+        {"stored", nil, 3, 5},
+        {"fanned-out", &PositionResponse{X: 9, Seq: 6}, 9, 6},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            wsMutex.Lock()
+            if tc.fanned != nil {
+                noteFanOutLocked(*tc.fanned)
+            }
+            wsMutex.Unlock()
+            t.Cleanup(func() {
+                wsMutex.Lock()
+                delete(fannedOut, "")
+                wsMutex.Unlock()
+            })
+
+            sendCurrentPosition(ctx, client)
+            var got CarState
+            if err := json.Unmarshal(<-client.send, &got); err != nil {
+                t.Fatal(err)
+            }
+            if got.X != tc.wantX || got.Seq != tc.wantSeq {
+                t.Errorf("snapshot x = %v, seq = %d; want x = %v, seq = %d", got.X, got.Seq, tc.wantX, tc.wantSeq)
+            }
+        })
+    }
+}
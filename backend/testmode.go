@@ -0,0 +1,75 @@
+package main
+
+import (
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "os"
+)
+
+// -------------------- TEST MODE -------------------- //
+
+// Whether test-only routes such as POST /test/seed are registered, from
+// TEST_MODE. Only the exact value "true" turns it on.
+var testMode bool
+
+// parseTestMode reads TEST_MODE. Anything but "true", "false" or unset is
+// fatal, so a typo in either direction never goes unnoticed.
+func parseTestMode() {
+    switch mode := os.Getenv("TEST_MODE"); mode {
+    case "", "false":
+    case "true":
+        testMode = true
+        slog.Warn("TEST_MODE is on: POST /test/seed lets anyone with the control token overwrite any key; never enable it in production")
+    default:
+        fatal("Invalid TEST_MODE value; it must be true or false", "value", mode)
+    }
+}
+
+// seedState sets each key of the JSON object in the body, e.g.
+// {"carPosition:x": 40, "carPosition:laps": 2}, to its value as is, for
+// setting up test scenarios. Keys get REDIS_PREFIX; null deletes the key.
+// Nothing is validated or broadcast; clients see the new state when they
+// (re)connect or send a sync.
+func seedState(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    var seed map[string]interface{}
+    if !decodeBody(w, r, &seed) {
+        return
+    }
+    var deletes []string
+    strs := make(map[string]string, len(seed))
+    for k, v := range seed {
+        switch v := v.(type) {
+        case nil:
+            deletes = append(deletes, key(k))
+        case string:
+            strs[key(k)] = v
+        case float64:
+            strs[key(k)] = formatFloat(v)
+        default:
+            writeJSONError(w, http.StatusBadRequest, "value of "+k+" must be a string, number or null")
+            return
+        }
+    }
+
+    for k, v := range strs {
+        if err := store.SetString(ctx, k, v, 0); err != nil {
+            writeJSONError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+    }
+    if len(deletes) > 0 {
+        if err := store.Delete(ctx, deletes...); err != nil {
+            writeJSONError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+    }
+    slog.WarnContext(ctx, "Seeded store state", "set", len(strs), "deleted", len(deletes))
+
+    _ = json.NewEncoder(w).Encode(seed)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+    "math"
+    "os"
+    "strconv"
+)
+
+// -------------------- TRACK -------------------- //
+
+// Length of a lap for racing, from TRACK_LENGTH. When set, X wraps into
+// [0, trackLength) instead of being clamped, and the car's lap counter goes
+// up each time it passes the start line and down when it backs over it.
+// 0, the default, leaves X clamped like Y.
+var trackLength float64
+
+// parseTrackLength reads TRACK_LENGTH, which must be positive and valid for
+// POSITION_MODE
+func parseTrackLength() {
+    lengthStr := os.Getenv("TRACK_LENGTH")
+    if lengthStr == "" {
+        return
+    }
+    length, err := strconv.ParseFloat(lengthStr, 64)
+    if err != nil || !representable(length) || length <= 0 {
+        fatal("Invalid TRACK_LENGTH value", "value", lengthStr)
+    }
+    trackLength = length
+}
+
+// lapsKey returns the Redis key counting the given car's laps
+func lapsKey(id string) string {
+    if id == "" {
+        return key("carLaps")
+    }
+    return key("carLaps:" + id)
+}
+
+// lapsCrossed is how many times a move from oldX to newX passed the start
+// line: positive going forward, negative going back. Counting each move's
+// own crossings keeps concurrent moves from counting one crossing twice.
+func lapsCrossed(oldX, newX float64) int64 {
+    return int64(math.Floor(newX/trackLength) - math.Floor(oldX/trackLength))
+}
+
+// placeOnTrack wraps p's X, as stored, into the lap and sets p.Lap from the
+// stored lap count. Stored X may run past the line until a move's wrap is
+// written, so every reader goes through here. Without TRACK_LENGTH it does
+// nothing.
+func (p *PositionResponse) placeOnTrack(laps float64) {
+    if trackLength == 0 {
+        return
+    }
+    wraps := math.Floor(p.X / trackLength)
+    lap := int64(laps + wraps)
+    p.X -= wraps * trackLength
+    p.Position = p.X
+    p.Lap = &lap
+}
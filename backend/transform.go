@@ -0,0 +1,52 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "math"
+)
+
+// -------------------- DELTA TRANSFORM -------------------- //
+
+// deltaTransform is an extension point for game rules such as friction,
+// speed caps or acceleration curves. When set, it is called once per axis
+// of every move (HTTP, WebSocket, batch or velocity tick) with the axis'
+// current position and the requested delta, and returns the delta to
+// apply. nil, the default, applies deltas unchanged. With
+// MOVEMENT_MODE=velocity-time it gets velocities instead, which are then
+// scaled by the time since the last move.
+//
+// It must be deterministic and free of side effects: it may run again when
+// a move is retried, and dry runs call it without moving anything. current
+// is read just before the increment, so a concurrent move may land in
+// between. In int mode the result is truncated to a whole number; bounds
+// and laps are applied to the result as usual. Set it before the server
+// starts.
+var deltaTransform func(current, delta float64) float64
+
+// transformDelta returns the deltas a move of car id by (dx, dy) applies.
+// It only reads the position when deltaTransform is set.
+func transformDelta(ctx context.Context, id string, dx, dy float64) (float64, float64, error) {
+    if deltaTransform == nil {
+        return dx, dy, nil
+    }
+    pos, err := readPosition(ctx, id)
+    if err != nil {
+        return 0, 0, err
+    }
+    return transformFrom(pos, dx, dy)
+}
+
+// transformFrom applies deltaTransform to a move from pos
+func transformFrom(pos PositionResponse, dx, dy float64) (float64, float64, error) {
+    dx, dy = deltaTransform(pos.X, dx), deltaTransform(pos.Y, dy)
+    if !floatPositions {
+        dx, dy = math.Trunc(dx), math.Trunc(dy)
+    }
+    for _, d := range []float64{dx, dy} {
+        if math.IsNaN(d) || math.IsInf(d, 0) {
+            return 0, 0, fmt.Errorf("delta transform returned %v", d)
+        }
+    }
+    return dx, dy, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+// dialTestConn returns the server side of a real WebSocket connection, and
+// the dialing side, which the test closes to end the server's reads
+func dialTestConn(t *testing.T) (server, peer *websocket.Conn) {
+    t.Helper()
+    conns := make(chan *websocket.Conn, 1)
+    upgrader := websocket.Upgrader{}
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            t.Errorf("upgrade: %v", err)
+            return
+        }
+        conns <- conn
+    }))
+    t.Cleanup(srv.Close)
+
+    peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    t.Cleanup(func() { peer.Close() })
+    return <-conns, peer
+}
+
+// TestUnregisterConcurrently has the reader, the writer and shutdown all
+// unregister the same client at once, as when a client drops mid-shutdown.
+// Run it with -race.
+func TestUnregisterConcurrently(t *testing.T) {
+    for i := 0; i < 20; i++ {
+        conn, peer := dialTestConn(t)
+        client := &wsClient{
+            id:       "racer",
+            ip:       "192.0.2.2",
+            encoding: encodingMsgpack,
+            shape:    shapeStandard,
+            conn:     conn,
+            send:     make(chan []byte, 1),
+        }
+
+        wsMutex.Lock()
+        wsClients[client.conn] = client
+        wsClientsByID[client.id] = client
+        // A second slot of the same IP, so releasing it twice would show
+        wsPerIP[client.ip] += 2
+        clientsBefore := len(wsClients)
+        wsMutex.Unlock()
+        msgpackClients.Add(1)
+        msgpackBefore := msgpackClients.Load()
+
+        var wg sync.WaitGroup
+        wg.Add(3)
+        wsWG.Add(1)
+        go func() {
+            defer wg.Done()
+            handleWSRead(client)
+        }()
+        go func() {
+            defer wg.Done()
+            handleWSWrite(client)
+        }()
+        go func() {
+            defer wg.Done()
+            closeAllClients()
+        }()
+        // Ends the reader, if shutdown hasn't already
+        peer.Close()
+        wg.Wait()
+
+        wsMutex.Lock()
+        clientsAfter := len(wsClients)
+        _, byID := wsClientsByID[client.id]
+        slots := wsPerIP[client.ip]
+        delete(wsPerIP, client.ip)
+        wsMutex.Unlock()
+
+        if clientsAfter != clientsBefore-1 || byID {
+            t.Fatalf("clients went from %d to %d (still by id: %v), want one fewer", clientsBefore, clientsAfter, byID)
+        }
+        if slots != 1 {
+            t.Fatalf("IP slots left = %d, want 1: the client's was released more than once", slots)
+        }
+        if got := msgpackClients.Load(); got != msgpackBefore-1 {
+            t.Fatalf("msgpack clients went from %d to %d, want one fewer", msgpackBefore, got)
+        }
+        if _, ok := <-client.send; ok {
+            t.Fatal("send is still open")
+        }
+    }
+}
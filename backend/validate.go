@@ -0,0 +1,173 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "reflect"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// -------------------- VALIDATION -------------------- //
+
+// FieldError is one problem with one field of a request body
+type FieldError struct {
+    Field string   `json:"field"`
+    Error string   `json:"error"`
+    Value *float64 `json:"value,omitempty"`
+}
+
+// bodyValidator is implemented by request bodies with checks struct tags
+// can't express, such as limits from the live Config
+type bodyValidator interface {
+    validate() []FieldError
+}
+
+// Compiled regex= patterns, keyed by pattern
+var tagPatterns sync.Map
+
+// validateBody checks a decoded request body and replies 400 listing every
+// problem at once. Fields are checked against their `validate` struct tag,
+// a comma-separated list of:
+//
+//     required   must not be the zero value (or nil)
+//     min=N      number at least N, or string/slice length at least N
+//     max=N      number at most N, or string/slice length at most N
+//     regex=RE   string must match RE; must come last, as RE may hold commas
+//
+// Nil pointers are only checked by required. Afterwards dst's own validate
+// method runs, if it has one.
+func validateBody(w http.ResponseWriter, dst interface{}) bool {
+    errs := validateTags(dst)
+    if v, ok := dst.(bodyValidator); ok {
+        errs = append(errs, v.validate()...)
+    }
+    if len(errs) == 0 {
+        return true
+    }
+    writeErrorResponse(w, fieldErrorResponse(errs))
+    return false
+}
+
+// fieldErrorResponse builds the 400 for errs. Error joins the messages, and
+// a lone error keeps its Value, so clients reading only those still work.
+func fieldErrorResponse(errs []FieldError) ErrorResponse {
+    msgs := make([]string, len(errs))
+    for i, e := range errs {
+        msgs[i] = e.Error
+    }
+    resp := ErrorResponse{
+        Error:  strings.Join(msgs, "; "),
+        Status: http.StatusBadRequest,
+        Errors: errs,
+    }
+    if len(errs) == 1 {
+        resp.Value = errs[0].Value
+    }
+    return resp
+}
+
+// validateTags runs the `validate` tags of the struct dst points to
+func validateTags(dst interface{}) []FieldError {
+    v := reflect.Indirect(reflect.ValueOf(dst))
+    if v.Kind() != reflect.Struct {
+        return nil
+    }
+
+    var errs []FieldError
+    t := v.Type()
+    for i := 0; i < t.NumField(); i++ {
+        tag, ok := t.Field(i).Tag.Lookup("validate")
+        if !ok {
+            continue
+        }
+        name := jsonName(t.Field(i))
+        field := v.Field(i)
+        for tag != "" {
+            var rule string
+            if strings.HasPrefix(tag, "regex=") {
+                rule, tag = tag, ""
+            } else {
+                rule, tag, _ = strings.Cut(tag, ",")
+            }
+            if e := checkRule(name, field, rule); e != nil {
+                errs = append(errs, *e)
+            }
+        }
+    }
+    return errs
+}
+
+// checkRule applies one tag rule to field, returning the violation if any
+func checkRule(name string, field reflect.Value, rule string) *FieldError {
+    op, arg, _ := strings.Cut(rule, "=")
+    if op == "required" {
+        if field.IsZero() {
+            return &FieldError{Field: name, Error: name + " is required"}
+        }
+        return nil
+    }
+
+    if field.Kind() == reflect.Ptr {
+        if field.IsNil() {
+            return nil
+        }
+        field = field.Elem()
+    }
+
+    switch op {
+    case "min", "max":
+        limit, err := strconv.ParseFloat(arg, 64)
+        if err != nil {
+            panic(fmt.Sprintf("validate: bad %s limit %q on %s", op, arg, name))
+        }
+        n, isNumber := numberOf(field)
+        if !isNumber {
+            n = float64(field.Len())
+        }
+        if (op == "min" && n >= limit) || (op == "max" && n <= limit) {
+            return nil
+        }
+        bound := "at least"
+        if op == "max" {
+            bound = "at most"
+        }
+        if !isNumber {
+            return &FieldError{Field: name, Error: fmt.Sprintf("%s must have length %s %v", name, bound, limit)}
+        }
+        return &FieldError{Field: name, Error: fmt.Sprintf("%s must be %s %v", name, bound, limit), Value: &n}
+    case "regex":
+        re, ok := tagPatterns.Load(arg)
+        if !ok {
+            re, _ = tagPatterns.LoadOrStore(arg, regexp.MustCompile(arg))
+        }
+        if !re.(*regexp.Regexp).MatchString(field.String()) {
+            return &FieldError{Field: name, Error: fmt.Sprintf("%s must match %s", name, arg)}
+        }
+        return nil
+    }
+    panic(fmt.Sprintf("validate: unknown rule %q on %s", rule, name))
+}
+
+// numberOf returns field as a float64, if it is a number
+func numberOf(field reflect.Value) (float64, bool) {
+    switch field.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return float64(field.Int()), true
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return float64(field.Uint()), true
+    case reflect.Float32, reflect.Float64:
+        return field.Float(), true
+    }
+    return 0, false
+}
+
+// jsonName is the field's name in JSON bodies, so errors match what clients sent
+func jsonName(f reflect.StructField) string {
+    if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" && name != "-" {
+        return name
+    }
+    return f.Name
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// -------------------- VELOCITY -------------------- //
+
+// Redis keys holding the velocity applied to the original car every tick
+const (
+    velocityKeyX = "carVelocity:x"
+    velocityKeyY = "carVelocity:y"
+)
+
+// tickLockPrefix + tick number is claimed with SET NX by whichever instance
+// applies that tick, so replicas don't each advance the car.
+const tickLockPrefix = "carVelocity:tick:"
+
+// How often velocity is applied to the position, from TICK_MS, until PUT
+// /admin/tick stores an interval in tickIntervalKey for every instance:
+var tickInterval = 100 * time.Millisecond
+
+// Redis key holding the tick interval set by PUT /admin/tick, in milliseconds
+const tickIntervalKey = "carVelocity:tickMs"
+
+// Bounds for PUT /admin/tick; shorter ticks would busy-loop the ticker
+const (
+    minTickInterval = 10 * time.Millisecond
+    maxTickInterval = time.Minute
+)
+
+// TickRequest is the JSON body for PUT /admin/tick
+type TickRequest struct {
+    IntervalMs int64 `json:"intervalMs" validate:"required,min=10,max=60000"`
+}
+
+// TickResponse reports the tick interval every instance applies
+type TickResponse struct {
+    IntervalMs int64 `json:"intervalMs"`
+}
+
+// VelocityRequest is the JSON body for POST /velocity. Like DeltaRequest,
+// the plain "velocity" form applies to X.
+type VelocityRequest struct {
+    Velocity int `json:"velocity"`
+    VX       int `json:"vx"`
+    VY       int `json:"vy"`
+}
+
+// VelocityResponse reports the stored velocity. Velocity mirrors VX.
+type VelocityResponse struct {
+    Velocity int `json:"velocity"`
+    VX       int `json:"vx"`
+    VY       int `json:"vy"`
+}
+
+// setVelocity stores how far the car moves on each tick; 0 stops it
+func setVelocity(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    var req VelocityRequest
+    if !decodeBody(w, r, &req) {
+        return
+    }
+    vx := req.VX + req.Velocity
+    vy := req.VY
+
+    // Each tick is an update, so the same delta bound applies
+    maxDelta := currentConfig().MaxDelta
+    for _, v := range []int{vx, vy} {
+        if v > maxDelta || v < -maxDelta {
+            value := float64(v)
+            writeErrorResponse(w, ErrorResponse{
+                Error:  fmt.Sprintf("velocity must be between %d and %d", -maxDelta, maxDelta),
+                Status: http.StatusBadRequest,
+                Value:  &value,
+            })
+            return
+        }
+    }
+
+    if err := store.Set(ctx, map[string]int64{key(velocityKeyX): int64(vx), key(velocityKeyY): int64(vy)}); err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    slog.InfoContext(ctx, "Velocity set", "vx", vx, "vy", vy)
+
+    _ = json.NewEncoder(w).Encode(VelocityResponse{Velocity: vx, VX: vx, VY: vy})
+}
+
+// runVelocityTicker applies the stored velocity every tick until ctx is
+// cancelled. A new interval from PUT /admin/tick is picked up with the
+// velocity, and takes over from the following tick.
+func runVelocityTicker(ctx context.Context) {
+    defer tasksWG.Done()
+
+    interval := tickInterval
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            if next := velocityTick(ctx, now, interval); next != interval {
+                slog.Info("Tick interval changed", "from", interval.String(), "to", next.String())
+                interval = next
+                ticker.Reset(interval)
+            }
+        }
+    }
+}
+
+// velocityTick advances the car by its velocity, going through applyDelta
+// so the usual clamping and broadcast rules apply. It returns the interval
+// to tick at from now on, which is interval unless one was stored.
+func velocityTick(ctx context.Context, now time.Time, interval time.Duration) time.Duration {
+    // The car is frozen in maintenance mode, velocity and all, and only the
+    // replay moves it in replay mode
+    if maintenanceMode.Load() || replaySteps != nil {
+        return interval
+    }
+    v, err := store.Get(ctx, key(velocityKeyX), key(velocityKeyY), key(tickIntervalKey))
+    if err != nil {
+        slog.Error("Error reading velocity", "error", err)
+        return interval
+    }
+    next := storedTickInterval(v[2])
+    if v[0] == 0 && v[1] == 0 {
+        return next
+    }
+
+    // Claim this tick so only one instance applies it
+    tick := now.UnixMilli() / interval.Milliseconds()
+    claimed, err := store.SetNX(ctx, key(tickLockPrefix+strconv.FormatInt(tick, 10)), "1", 2*interval)
+    if err != nil {
+        slog.Error("Error claiming velocity tick", "error", err)
+        return next
+    }
+    if !claimed {
+        return next
+    }
+
+    if _, err := applyDelta(withWriter(ctx, tickerWriter), "", float64(v[0]), float64(v[1])); err != nil {
+        slog.Error("Error applying velocity", "error", err)
+    }
+    return next
+}
+
+// storedTickInterval is the interval in tickIntervalKey, ms milliseconds,
+// falling back to TICK_MS when none (or an out-of-range one) is stored
+func storedTickInterval(ms int64) time.Duration {
+    d := time.Duration(ms) * time.Millisecond
+    if d < minTickInterval || d > maxTickInterval {
+        return tickInterval
+    }
+    return d
+}
+
+// getTick reports the tick interval every instance applies
+func getTick(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    v, err := store.Get(ctx, key(tickIntervalKey))
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    _ = json.NewEncoder(w).Encode(TickResponse{IntervalMs: storedTickInterval(v[0]).Milliseconds()})
+}
+
+// putTick stores a new tick interval, which every instance's ticker picks
+// up within one tick, without a restart. It overrides TICK_MS until cleared
+// from Redis.
+func putTick(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    var req TickRequest
+    if !decodeBody(w, r, &req) || !validateBody(w, &req) {
+        return
+    }
+
+    if err := store.Set(ctx, map[string]int64{key(tickIntervalKey): req.IntervalMs}); err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    slog.InfoContext(ctx, "Tick interval set", "interval_ms", req.IntervalMs)
+
+    _ = json.NewEncoder(w).Encode(TickResponse{IntervalMs: req.IntervalMs})
+}
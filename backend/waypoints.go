@@ -0,0 +1,141 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "github.com/gorilla/mux"
+)
+
+// -------------------- WAYPOINTS -------------------- //
+
+// waypointsKey is the Redis hash mapping waypoint names to JSON Waypoints
+const waypointsKey = "waypoints"
+
+// Waypoint is a named position cars can be sent to
+type Waypoint struct {
+    Name string  `json:"name,omitempty"`
+    X    float64 `json:"x"`
+    Y    float64 `json:"y"`
+}
+
+// WaypointRequest is the JSON body for PUT /waypoints/{name}. Position is an
+// alias for X; omitted axes are 0.
+type WaypointRequest struct {
+    Position *float64 `json:"position"`
+    X        float64  `json:"x"`
+    Y        float64  `json:"y"`
+}
+
+// GotoRequest is the JSON body for POST /position/goto
+type GotoRequest struct {
+    Waypoint string `json:"waypoint"`
+}
+
+// putWaypoint defines or replaces the waypoint named in the URL. Names
+// follow the same rules as car IDs.
+func putWaypoint(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    name := mux.Vars(r)["name"]
+    if !carIDPattern.MatchString(name) {
+        writeJSONError(w, http.StatusBadRequest, "invalid waypoint name")
+        return
+    }
+
+    var req WaypointRequest
+    if !decodeBody(w, r, &req) {
+        return
+    }
+    wp := Waypoint{X: req.X, Y: req.Y}
+    if req.Position != nil {
+        wp.X = *req.Position
+    }
+    for _, v := range []float64{wp.X, wp.Y} {
+        if !representable(v) {
+            value := v
+            writeErrorResponse(w, ErrorResponse{
+                Error:  "position must be a whole number",
+                Status: http.StatusBadRequest,
+                Value:  &value,
+            })
+            return
+        }
+        if _, clamped := clampPosition(v); clamped {
+            value := v
+            writeErrorResponse(w, ErrorResponse{
+                Error:  boundsError(),
+                Status: http.StatusBadRequest,
+                Value:  &value,
+            })
+            return
+        }
+    }
+
+    data, _ := json.Marshal(wp)
+    if err := store.HashSet(ctx, key(waypointsKey), name, string(data)); err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    wp.Name = name
+    _ = json.NewEncoder(w).Encode(wp)
+}
+
+// gotoWaypoint moves the car to a named waypoint, then broadcasts
+func gotoWaypoint(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    ctx, cancel := requestContext(r)
+    defer cancel()
+
+    id, ok := carIDFromRequest(r)
+    if !ok {
+        writeJSONError(w, http.StatusBadRequest, "invalid car id")
+        return
+    }
+
+    var req GotoRequest
+    if !decodeBody(w, r, &req) {
+        return
+    }
+    if req.Waypoint == "" {
+        writeJSONError(w, http.StatusBadRequest, "waypoint is required")
+        return
+    }
+
+    data, found, err := store.HashGet(ctx, key(waypointsKey), req.Waypoint)
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    if !found {
+        writeJSONError(w, http.StatusNotFound, "unknown waypoint")
+        return
+    }
+    var wp Waypoint
+    if err := json.Unmarshal([]byte(data), &wp); err != nil {
+        writeJSONError(w, http.StatusInternalServerError, "malformed waypoint: "+err.Error())
+        return
+    }
+
+    // The bounds may have changed since the waypoint was defined
+    x, xClamped := clampPosition(wp.X)
+    y, yClamped := clampPosition(wp.Y)
+    xKey, yKey := positionKeys(id)
+    pos, err := storePosition(ctx, id, map[string]float64{xKey: x, yKey: y})
+    if err != nil {
+        writeJSONError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    publishPosition(ctx, pos)
+
+    _ = json.NewEncoder(w).Encode(UpdateResponse{
+        PositionResponse: pos,
+        Clamped:          xClamped || yClamped,
+    })
+}